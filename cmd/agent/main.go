@@ -2,8 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/roadtoseniors/apicalc/pkg/settings"
 
 	"github.com/roadtoseniors/apicalc/internal/agent/application"
 	"github.com/roadtoseniors/apicalc/internal/agent/config"
@@ -11,14 +17,25 @@ import (
 
 func main() {
 	cfg, err := config.NewConfigAg()
+	if errors.Is(err, settings.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	app, err := application.NewApplication(cfg)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	app := application.NewApplication(cfg)
+	// по сигналу агент перестаёт брать задачи и завершает начатые
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	exitCode := app.Run(context.Background())
+	exitCode := app.Run(ctx)
 
 	os.Exit(exitCode)
 }
\ No newline at end of file
@@ -2,15 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 
+	"github.com/roadtoseniors/apicalc/pkg/settings"
+
 	"github.com/roadtoseniors/apicalc/internal/orchestrator/application"
 	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
 )
 
 func main() {
 	cfg, err := config.NewConfigOrch()
+	if errors.Is(err, settings.ErrPrinted) || errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
@@ -0,0 +1,86 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WorkersRequest - новый размер пула воркеров
+type WorkersRequest struct {
+	Workers int `json:"workers"`
+}
+
+// WorkersResponse - текущий размер пула воркеров
+type WorkersResponse struct {
+	Workers int `json:"workers"`
+}
+
+// запускаем HTTP-сервер управления агентом
+func (app *Application) runAdmin() (func(), error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/workers", app.getWorkers)
+	mux.HandleFunc("PUT /admin/workers", app.putWorkers)
+
+	addr := net.JoinHostPort(app.cfg.AdminAddr, strconv.Itoa(app.cfg.AdminPort))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("admin listen error: %w", err)
+	}
+
+	srv := &http.Server{Handler: mux}
+	app.logger.Printf("Admin server on %s\n", addr)
+
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			app.logger.Printf("Admin server error: %v\n", err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}, nil
+}
+
+// возвращаем размер пула
+func (app *Application) getWorkers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	encoder.Encode(WorkersResponse{Workers: app.pool.size()})
+}
+
+// меняем размер пула
+func (app *Application) putWorkers(w http.ResponseWriter, r *http.Request) {
+	var req WorkersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	before := app.pool.size()
+	if err := app.pool.resize(req.Workers); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	app.logger.Printf("Workers resized from %d to %d\n", before, req.Workers)
+
+	// оркестратор должен узнать о новом количестве воркеров
+	select {
+	case app.reregister <- struct{}{}:
+	default:
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	encoder.Encode(WorkersResponse{Workers: app.pool.size()})
+}
@@ -2,106 +2,533 @@ package application
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"log"
 	"math"
+	"net/http"
+	"os"
+	"slices"
 	"strconv"
 	"time"
 
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/roadtoseniors/apicalc/pkg/backoff"
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+
 	"github.com/roadtoseniors/apicalc/internal/agent/config"
+	"github.com/roadtoseniors/apicalc/internal/agent/plugin"
+	"github.com/roadtoseniors/apicalc/internal/agentauth"
+	grpcclient "github.com/roadtoseniors/apicalc/internal/grpc/client"
 	"github.com/roadtoseniors/apicalc/internal/http/client"
+	"github.com/roadtoseniors/apicalc/internal/registration"
 	"github.com/roadtoseniors/apicalc/internal/result"
 	"github.com/roadtoseniors/apicalc/internal/task"
 )
 
 // Application представляет основное приложение агента
 type Application struct {
-	cfg     config.Config      
-	client  *client.Client     
-	tasks   chan task.Task     
+	cfg     config.Config
+	client  transport
+	tasks   chan task.Task
 	results chan result.Result
 	ready   chan struct{}
+	logger  *log.Logger
+	outbox  outbox
+	stats   deliveryStats
+	pool    *pool
+	retired chan struct{}
+	plugins []*plugin.Plugin
+	custom  []registration.CustomOperation // операции плагинов для оркестратора
+	// сигнал обновить сведения об агенте на оркестраторе
+	reregister chan struct{}
+}
+
+// transport - способ обмена задачами и результатами с оркестратором
+type transport interface {
+	GetTasks(ctx context.Context, limit int) []task.Task
+	SendResults(results []result.Result) error
+	Register(reg registration.Registration) error
+	Heartbeat(id string) error
+	Deregister(id string) error
 }
 
-var ops map[string]func(float64, float64) float64
+func NewApplication(cfg *config.Config) (*Application, error) {
+	// Создаём клиент для выбранного транспорта
+	retryBackoff := backoff.Backoff{Base: cfg.RetryBase, Max: cfg.RetryMax}
+
+	httpClient := &client.Client{
+		Host:    cfg.Hostname,
+		Port:    cfg.Port,
+		TLS:     cfg.TLS,
+		Wait:    cfg.PollWait,
+		AgentID: cfg.AgentID,
+		Token:   cfg.AgentToken,
+		Retry:   cfg.RetryAttempts,
+		Backoff: retryBackoff,
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS {
+		var err error
+		tlsConfig, err = newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	var tr transport = httpClient
+	if cfg.Transport == "grpc" {
+		var opts []grpc.DialOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		if len(cfg.AgentToken) != 0 {
+			opts = append(opts, grpc.WithPerRPCCredentials(agentauth.Credentials{
+				Token:  cfg.AgentToken,
+				Secure: cfg.TLS,
+			}))
+		}
+
+		grpcClient, err := grpcclient.NewClient(cfg.Hostname, cfg.GRPCPort, cfg.PollWait, cfg.AgentID, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("grpc client initialization error: %w", err)
+		}
+		grpcClient.Retry = cfg.RetryAttempts
+		grpcClient.Backoff = retryBackoff
+		tr = grpcClient
+	}
+
+	app := &Application{
+		cfg:     *cfg,                                   // Сохраняем конфигурацию
+		client:  tr,                                     // Клиент оркестратора
+		tasks:   make(chan task.Task),                   // Инициализируем канал для задач
+		results: make(chan result.Result),               // Инициализируем канал для результатов
+		ready:   make(chan struct{}, cfg.GorutineCount), // Инициализируем канал для готовности воркеров
+		logger: log.New(
+			os.Stderr,
+			"Agent: ",
+			log.Ldate|log.Ltime|log.Lmsgprefix,
+		),
+		outbox: outbox{size: cfg.OutboxSize},
+	}
+	if len(cfg.PluginsFile) != 0 {
+		if err := app.loadPlugins(cfg.PluginsFile); err != nil {
+			return nil, err
+		}
+	}
+
+	app.retired = make(chan struct{})
+	app.reregister = make(chan struct{}, 1)
+	app.pool = &pool{
+		tasks:   app.tasks,
+		results: app.results,
+		ready:   app.ready,
+		retired: app.retired,
+		stop:    make(chan struct{}),
+		abort:   make(chan struct{}),
+	}
 
-func init() {
-	ops = make(map[string]func(float64, float64) float64)
-	ops["+"] = addition
-	ops["-"] = subtraction
-	ops["*"] = multiplication
-	ops["/"] = division
+	return app, nil
 }
 
-func addition(a, b float64) float64       { return a + b }
-func subtraction(a, b float64) float64    { return a - b }
-func multiplication(a, b float64) float64 { return a * b }
-func division(a, b float64) float64       { return a / b }
+// настройки TLS для подключения к оркестратору
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if len(cfg.TLSCAFile) != 0 {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read TLS_CA_FILE: %w", err)
+		}
 
-func NewApplication(cfg *config.Config) *Application {
-	return &Application{
-		cfg:     *cfg,                                                   // Сохраняем конфигурацию
-		client:  &client.Client{Host: cfg.Hostname, Port: cfg.Port}, // Создаём HTTP-клиент
-		tasks:   make(chan task.Task),                                   // Инициализируем канал для задач
-		results: make(chan result.Result),                               // Инициализируем канал для результатов
-		ready:   make(chan struct{}, cfg.GorutineCount),                // Инициализируем канал для готовности воркеров
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CA_FILE: no certificates found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// клиентский сертификат подтверждает оркестратору, что это агент
+	if len(cfg.TLSCertFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
+
+	return tlsConfig, nil
 }
 
+// Run работает до отмены ctx, после чего перестаёт брать задачи,
+// даёт воркерам завершить начатое и отдаёт оркестратору остальное.
 func (app *Application) Run(ctx context.Context) int {
-	defer close(app.results)
-	defer close(app.tasks)
+	if err := app.pool.resize(app.cfg.GorutineCount); err != nil {
+		app.logger.Printf("Workers start error: %v\n", err)
+		return 1
+	}
 
-	for i := 0; i < app.cfg.GorutineCount; i++ {
-		go runWorker(app.tasks, app.results, app.ready)
+	// размер пула можно менять через административный HTTP-интерфейс
+	if app.cfg.AdminPort > 0 {
+		stopAdmin, err := app.runAdmin()
+		if err != nil {
+			app.logger.Printf("Run admin server error: %v\n", err)
+			return 1
+		}
+		defer stopAdmin()
 	}
 
+	// регистрация живёт, пока агент не отдаст задачи
+	registrationCtx, cancelRegistration := context.WithCancel(context.Background())
+	defer cancelRegistration()
+	go app.keepRegistered(registrationCtx)
+
+	// задачи запрашиваются отдельно, чтобы долгий опрос не задерживал результаты;
+	// отмена ctx прерывает и текущий запрос задач
+	fetched := make(chan struct{})
+	go func() {
+		defer close(fetched)
+		app.fetchTasks(ctx)
+	}()
+
+	// результаты доставляются отдельно, повторы не задерживают цикл
+	deliveries := make(chan []result.Result, 1)
+	delivered := make(chan struct{})
+	go app.deliverResults(deliveries, delivered)
+
+	flush := time.NewTicker(app.cfg.ResultFlush)
+	defer flush.Stop()
+
+	var pending []result.Result
+	var grace <-chan time.Time
+	var workersDone <-chan struct{}
+	shutdown := ctx.Done()
+
 	for {
 		select {
-		case <-ctx.Done():
+		case <-shutdown:
+			app.logger.Printf("Draining, grace period %v\n", app.cfg.ShutdownGrace)
+			shutdown = nil
+			workersDone = app.pool.shutdown()
+			grace = time.After(app.cfg.ShutdownGrace)
+		case <-grace:
+			app.logger.Printf("Grace period expired, handing back unfinished tasks\n")
+			grace = nil
+			close(app.pool.abort)
+		case <-workersDone:
+			// последняя пачка, затем ждём окончания доставки
+			deliveries <- pending
+			close(deliveries)
+			<-delivered
+
+			// уходим из реестра, только когда новых задач уже не будет:
+			// оркестратор вернёт в очередь и полученные, но не начатые
+			<-fetched
+			app.handBack()
+			app.logger.Printf(
+				"Stopped: %d results delivered, %d delivery failures, %d dropped, %d rejected, %d undelivered\n",
+				app.stats.delivered,
+				app.stats.failed,
+				app.stats.dropped,
+				app.stats.rejected,
+				app.outbox.len(),
+			)
 			return 0
 		case res := <-app.results:
-			app.client.SendResult(res)
-		case <-app.ready:
-			task := app.client.GetTask()
-			if task == nil {
-				app.ready <- struct{}{}
-			} else {
-				app.tasks <- *task
+			pending = append(pending, res)
+			if len(pending) >= app.cfg.ResultBatch {
+				pending = handOff(deliveries, pending)
+			}
+		case <-flush.C:
+			// и пустая пачка: доставка повторит отложенные результаты
+			pending = handOff(deliveries, pending)
+		}
+	}
+}
+
+// уходим из реестра: оркестратор сразу вернёт в очередь незавершённые задачи агента
+func (app *Application) handBack() {
+	if err := app.client.Deregister(app.cfg.AgentID); err != nil {
+		app.logger.Printf("Deregistration error: %v\n", err)
+	}
+
+	if closer, ok := app.client.(io.Closer); ok {
+		closer.Close()
+	}
+
+	for _, p := range app.plugins {
+		p.Close()
+	}
+}
+
+// запускаем внешние исполнители и регистрируем их операции
+func (app *Application) loadPlugins(path string) error {
+	configs, err := plugin.Load(path)
+	if err != nil {
+		return err
+	}
+
+	for _, cfg := range configs {
+		p := plugin.New(cfg, app.logger)
+		app.plugins = append(app.plugins, p)
+
+		for _, op := range cfg.Operations {
+			duration := time.Duration(op.DurationMs) * time.Millisecond
+			err := operation.Register(operation.Operation{
+				Symbol:   op.Symbol,
+				Arity:    op.Arity,
+				Function: true,
+				Duration: duration,
+				Func:     app.pluginFunc(p, op.Symbol),
+			})
+			if err != nil {
+				return fmt.Errorf("plugin %q: %w", cfg.Name, err)
 			}
+
+			app.custom = append(app.custom, registration.CustomOperation{
+				Symbol:   op.Symbol,
+				Arity:    op.Arity,
+				Duration: duration,
+			})
 		}
 	}
+
+	return nil
+}
+
+// реализация операции через исполнитель, ошибка даёт NaN
+func (app *Application) pluginFunc(p *plugin.Plugin, symbol string) func(args ...float64) float64 {
+	return func(args ...float64) float64 {
+		value, err := p.Call(symbol, args)
+		if err != nil {
+			app.logger.Printf("Operation %s: %v\n", symbol, err)
+			return math.NaN()
+		}
+
+		return value
+	}
 }
 
-// runWorker выполняет задачи
-func runWorker(
-	tasks <-chan task.Task,
-	results chan<- result.Result, 
-	ready chan<- struct{},
-) {
+// отдаём пачку доставке; пока она занята, результаты копятся дальше
+func handOff(deliveries chan<- []result.Result, pending []result.Result) []result.Result {
+	select {
+	case deliveries <- pending:
+		return nil
+	default:
+		return pending
+	}
+}
+
+// доставляем пачки по очереди, outbox и stats принадлежат этой горутине
+func (app *Application) deliverResults(batches <-chan []result.Result, done chan<- struct{}) {
+	defer close(done)
+
+	for batch := range batches {
+		app.sendResults(batch)
+	}
+}
+
+// отправляем пачку и ранее недоставленные результаты одним запросом
+func (app *Application) sendResults(pending []result.Result) {
+	batch := append(app.outbox.take(), pending...)
+	if len(batch) == 0 {
+		return
+	}
+
+	err := app.client.SendResults(batch)
+	switch {
+	case err == nil:
+		app.stats.delivered += len(batch)
+	case backoff.IsPermanent(err):
+		// повтор получит тот же отказ, откладывать нечего
+		app.stats.rejected += len(batch)
+		app.logger.Printf("Result delivery rejected: %v; %d results dropped\n", err, len(batch))
+	default:
+		app.stats.failed += len(batch)
+		dropped := app.outbox.put(batch)
+		app.stats.dropped += dropped
+		app.logger.Printf(
+			"Result delivery failed: %v; %d results kept in outbox, %d dropped\n",
+			err,
+			app.outbox.len(),
+			dropped,
+		)
+	}
+}
+
+// регистрируемся на оркестраторе и регулярно сообщаем, что живы
+func (app *Application) keepRegistered(ctx context.Context) {
+	hostname, _ := os.Hostname()
+	reg := registration.Registration{
+		ID:       app.cfg.AgentID,
+		Hostname: hostname,
+		// оркестратор выдаёт только задачи с этими операциями
+		Operations: operation.Symbols(),
+		Costs:      app.cfg.OperationCosts,
+		Subtrees:   true,
+		Custom:     app.custom,
+	}
+
+	registered := false
+	ticker := time.NewTicker(app.cfg.Heartbeat)
+	defer ticker.Stop()
+
 	for {
-		ready <- struct{}{}
+		if registered {
+			// оркестратор мог перезапуститься и забыть агента
+			if err := app.client.Heartbeat(reg.ID); err != nil {
+				app.logger.Printf("Heartbeat error: %v\n", err)
+				registered = false
+			}
+		}
+
+		if !registered {
+			reg.Workers = app.pool.size()
+			if err := app.client.Register(reg); err != nil {
+				app.logger.Printf("Registration error: %v\n", err)
+			} else {
+				app.logger.Printf("Registered as %q\n", reg.ID)
+				registered = true
+			}
+		}
 
-		task, ok := <-tasks
-		if !ok {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
+		case <-app.reregister:
+			// размер пула изменился
+			registered = false
+		}
+	}
+}
+
+// получаем задачи сразу для всех освободившихся воркеров
+func (app *Application) fetchTasks(ctx context.Context) {
+	idle := 0
+
+	for {
+		// ждём хотя бы одного свободного воркера
+		if idle <= 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-app.ready:
+				idle++
+			case <-app.retired:
+				idle--
+			}
 		}
 
-		time.Sleep(task.OperationTime)
+		// и забираем всех, кто освободился вместе с ним
+		for drained := false; !drained; {
+			select {
+			case <-app.ready:
+				idle++
+			case <-app.retired:
+				idle--
+			default:
+				drained = true
+			}
+		}
+
+		if idle <= 0 {
+			continue
+		}
 
-		arg1, err1 := strconv.ParseFloat(task.Arg1, 64)
-		arg2, err2 := strconv.ParseFloat(task.Arg2, 64)
+		if ctx.Err() != nil {
+			return
+		}
 
-		if err1 != nil || err2 != nil {
-			results <- result.Result{
-				ID:    task.ID,
-				Value: fmt.Sprintf("%f", math.NaN()),
+		batch := app.client.GetTasks(ctx, idle)
+		for i, task := range batch {
+			// пока ждём воркера, пул может вырасти или уменьшиться
+			for sent := false; !sent; {
+				select {
+				case <-ctx.Done():
+					// их вернёт оркестратору уход из реестра
+					app.logger.Printf("%d fetched tasks not started\n", len(batch)-i)
+					return
+				case app.tasks <- task:
+					idle--
+					sent = true
+				case <-app.ready:
+					idle++
+				case <-app.retired:
+					idle--
+				}
 			}
-		} else {
-			value := ops[task.Operation](arg1, arg2)
-			results <- result.Result{
-				ID:    task.ID,
-				Value: fmt.Sprintf("%f", value),
+		}
+	}
+}
+
+// вычисляем задачу
+func calculate(t task.Task) result.Result {
+	if t.Kind == task.KindSubtree {
+		value, err := evaluate(t.RPN)
+		if err != nil {
+			value = math.NaN()
+		}
+		return result.Result{
+			ID:    t.ID,
+			Value: fmt.Sprintf("%f", value),
+		}
+	}
+
+	return calculateOperation(t)
+}
+
+// вычисляем подвыражение в обратной польской записи
+func evaluate(rpnarr []string) (float64, error) {
+	var stack []float64
+
+	for _, token := range rpnarr {
+		op, found := operation.Lookup(token)
+		if !found {
+			num, err := strconv.ParseFloat(token, 64)
+			if err != nil {
+				return 0, fmt.Errorf("incorrect token %q", token)
 			}
+			stack = append(stack, num)
+			continue
+		}
+
+		if len(stack) < op.Arity {
+			return 0, fmt.Errorf("not enough operands for %q", token)
 		}
+		args := slices.Clone(stack[len(stack)-op.Arity:])
+		stack = append(stack[:len(stack)-op.Arity], op.Func(args...))
 	}
-}
\ No newline at end of file
+
+	if len(stack) != 1 {
+		return 0, fmt.Errorf("incorrect expression")
+	}
+
+	return stack[0], nil
+}
+
+// вычисляем одну операцию
+func calculateOperation(task task.Task) result.Result {
+	arg1, err1 := strconv.ParseFloat(task.Arg1, 64)
+	arg2, err2 := strconv.ParseFloat(task.Arg2, 64)
+	op, found := operation.Lookup(task.Operation)
+
+	if err1 != nil || err2 != nil || !found {
+		return result.Result{
+			ID:    task.ID,
+			Value: fmt.Sprintf("%f", math.NaN()),
+		}
+	}
+
+	value := op.Func(arg1, arg2)
+	return result.Result{
+		ID:    task.ID,
+		Value: fmt.Sprintf("%f", value),
+	}
+}
@@ -0,0 +1,40 @@
+package application
+
+import "github.com/roadtoseniors/apicalc/internal/result"
+
+// outbox хранит результаты, которые не удалось доставить оркестратору
+type outbox struct {
+	results []result.Result
+	size    int
+}
+
+// забираем всё накопленное для новой попытки
+func (o *outbox) take() []result.Result {
+	results := o.results
+	o.results = nil
+
+	return results
+}
+
+// откладываем результаты, при переполнении вытесняем самые старые,
+// возвращаем количество потерянных
+func (o *outbox) put(results []result.Result) int {
+	o.results = append(o.results, results...)
+
+	dropped := max(len(o.results)-o.size, 0)
+	o.results = o.results[dropped:]
+
+	return dropped
+}
+
+func (o *outbox) len() int {
+	return len(o.results)
+}
+
+// счётчики доставки результатов
+type deliveryStats struct {
+	delivered int // доставлено
+	failed    int // не доставлено после всех попыток, отложено
+	dropped   int // потеряно из-за переполнения outbox
+	rejected  int // отклонено оркестратором без повторов
+}
@@ -0,0 +1,121 @@
+package application
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/result"
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// максимальный размер пула воркеров
+const maxWorkers = 1024
+
+// pool - воркеры агента, количество которых меняется на ходу
+type pool struct {
+	locker  sync.Mutex
+	quits   []chan struct{} // у каждого воркера свой канал остановки
+	stopped bool
+	workers sync.WaitGroup
+
+	tasks   <-chan task.Task
+	results chan<- result.Result
+	ready   chan<- struct{} // воркер свободен
+	retired chan<- struct{} // свободный воркер остановлен и задачу не возьмёт
+	stop    chan struct{}   // все воркеры больше не берут задачи
+	abort   chan struct{}   // все воркеры бросают начатые задачи
+}
+
+// меняем количество воркеров, лишние завершаются после текущей задачи
+func (p *pool) resize(n int) error {
+	if n < 0 || n > maxWorkers {
+		return fmt.Errorf("workers count must be between 0 and %d", maxWorkers)
+	}
+
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.stopped {
+		return fmt.Errorf("agent is shutting down")
+	}
+
+	for len(p.quits) < n {
+		quit := make(chan struct{})
+		p.quits = append(p.quits, quit)
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			p.runWorker(quit)
+		}()
+	}
+
+	for len(p.quits) > n {
+		last := len(p.quits) - 1
+		close(p.quits[last])
+		p.quits = p.quits[:last]
+	}
+
+	return nil
+}
+
+func (p *pool) size() int {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	return len(p.quits)
+}
+
+// останавливаем все воркеры, канал закрывается, когда они завершатся
+func (p *pool) shutdown() <-chan struct{} {
+	p.locker.Lock()
+	p.stopped = true
+	p.locker.Unlock()
+
+	close(p.stop)
+
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// runWorker выполняет задачи, пока его не остановят
+func (p *pool) runWorker(quit <-chan struct{}) {
+	for {
+		select {
+		case p.ready <- struct{}{}:
+		case <-p.stop:
+			return
+		case <-quit:
+			return
+		}
+
+		var task task.Task
+		select {
+		case task = <-p.tasks:
+		case <-p.stop:
+			return
+		case <-quit:
+			// воркер уже объявил себя свободным, отзываем это
+			select {
+			case p.retired <- struct{}{}:
+			case <-p.stop:
+			}
+			return
+		}
+
+		// у подвыражения это суммарная задержка всех его операций
+		select {
+		case <-time.After(task.OperationTime):
+		case <-p.abort:
+			// задачу вернёт в очередь оркестратор
+			return
+		}
+
+		p.results <- calculate(task)
+	}
+}
@@ -1,46 +1,155 @@
 package config
 
 import (
-	"flag"
 	"fmt"
 	"os"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/settings"
 )
 
 type Config struct {
-	GorutineCount int
-	Hostname      string
-	Port          int
+	GorutineCount int           `key:"workers" env:"GORUTINE_COUNT" flag:"workers" min:"0" usage:"number of workers"`
+	Hostname      string        `key:"orchestrator_host" env:"ORCHESTRATOR_HOST" flag:"h" usage:"orchestrator adress"`
+	Port          int           `key:"orchestrator_port" env:"ORCHESTRATOR_PORT" flag:"p" min:"1" usage:"orchestrator port"`
+	PollWait      time.Duration `key:"poll_wait" env:"POLL_WAIT_MS"`
+	// сколько результатов отправлять одним запросом и как часто отправлять неполную пачку
+	ResultBatch int           `key:"result_batch_size" env:"RESULT_BATCH_SIZE" min:"1"`
+	ResultFlush time.Duration `key:"result_flush" env:"RESULT_FLUSH_MS" min:"1"`
+	Transport   string        `key:"transport" env:"TRANSPORT" flag:"transport" oneof:"http|grpc" usage:"transport to the orchestrator: http or grpc"`
+	GRPCPort    int           `key:"orchestrator_grpc_port" env:"ORCHESTRATOR_GRPC_PORT" flag:"g" min:"1" usage:"orchestrator grpc port"`
+	AgentID     string        `key:"agent_id" env:"AGENT_ID" flag:"id" usage:"agent ID, hostname-pid by default"`
+	// период сигналов оркестратору
+	Heartbeat time.Duration `key:"heartbeat" env:"HEARTBEAT_MS" min:"1"`
+	// относительная стоимость операций на этом агенте, по умолчанию 1:
+	// оркестратор отдаёт агенту сначала дешёвые для него задачи
+	OperationCosts Costs `key:"operation_costs" env:"OPERATION_COSTS"`
+	// сколько ждать завершения начатых задач при остановке
+	ShutdownGrace time.Duration `key:"shutdown_grace" env:"SHUTDOWN_GRACE_MS"`
+
+	// попытки доставить пачку результатов и задержки между ними
+	RetryAttempts int           `key:"retry_attempts" env:"RETRY_ATTEMPTS" min:"1"`
+	RetryBase     time.Duration `key:"retry_base" env:"RETRY_BASE_MS"`
+	RetryMax      time.Duration `key:"retry_max" env:"RETRY_MAX_MS"`
+	// сколько недоставленных результатов хранить
+	OutboxSize int `key:"outbox_size" env:"OUTBOX_SIZE" min:"0"`
+
+	// порт управления агентом, 0 - выключено
+	AdminPort int `key:"admin_port" env:"ADMIN_PORT" flag:"admin-port" min:"0" usage:"agent admin port, 0 disables it"`
+	// адрес управления, по умолчанию только локальный; пусто - все интерфейсы
+	AdminAddr string `key:"admin_addr" env:"ADMIN_ADDR" flag:"admin-addr" usage:"agent admin listen address"`
+
+	// описания внешних исполнителей пользовательских операций
+	PluginsFile string `key:"plugins_file" env:"PLUGINS_FILE"`
+
+	// обращаться к оркестратору по TLS; сертификат центра, которому доверяем, пусто - системные
+	TLS       bool   `key:"tls" env:"TLS" flag:"tls" usage:"connect to the orchestrator over TLS"`
+	TLSCAFile string `key:"tls_ca_file" env:"TLS_CA_FILE"`
+
+	// чем агент подтверждает оркестратору, что он агент: общий токен
+	// и/или клиентский сертификат с ключом
+	AgentToken  string `key:"agent_token" env:"AGENT_TOKEN" secret:"true"`
+	TLSCertFile string `key:"tls_client_cert_file" env:"TLS_CLIENT_CERT_FILE"`
+	TLSKeyFile  string `key:"tls_client_key_file" env:"TLS_CLIENT_KEY_FILE"`
 }
 
-func NewConfigAg() (*Config, error) {
-	gorutineCountStr := os.Getenv("GORUTINE_COUNT")
-	if len(gorutineCountStr) == 0 {
-		return nil, fmt.Errorf("environment variable GORUTINE_COUNT not specified")
+// Costs - стоимости операций, в тексте записываются как "+=1,*=2.5"
+type Costs map[string]float64
+
+func (c *Costs) UnmarshalText(text []byte) error {
+	costs := make(Costs)
+
+	for _, pair := range strings.Split(string(text), ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+
+		op, weight, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("expected op=weight, got %q", pair)
+		}
+
+		cost, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if err != nil || cost < 0 {
+			return fmt.Errorf("incorrect weight for %q", op)
+		}
+		costs[strings.TrimSpace(op)] = cost
+	}
+
+	*c = costs
+	return nil
+}
+
+func (c Costs) MarshalText() ([]byte, error) {
+	pairs := make([]string, 0, len(c))
+	for op, cost := range c {
+		pairs = append(pairs, fmt.Sprintf("%s=%g", op, cost))
 	}
+	slices.Sort(pairs)
+
+	return []byte(strings.Join(pairs, ",")), nil
+}
 
-	gorutineCount, err := strconv.Atoi(gorutineCountStr)
+// значения по умолчанию
+func defaultConfig() Config {
+	host, err := os.Hostname()
 	if err != nil {
-		return nil, fmt.Errorf("couldn't convert GORUTINE_COUNT in the number: %v", err)
+		host = "agent"
+	}
+
+	return Config{
+		GorutineCount: runtime.NumCPU(),
+		Hostname:      "localhost",
+		Port:          8081,
+		PollWait:      10 * time.Second,
+		ResultBatch:   16,
+		ResultFlush:   50 * time.Millisecond,
+		Transport:     "http",
+		GRPCPort:      8082,
+		AgentID:       fmt.Sprintf("%s-%d", host, os.Getpid()),
+		Heartbeat:     5 * time.Second,
+
+		ShutdownGrace: 10 * time.Second,
+
+		RetryAttempts: 5,
+		RetryBase:     100 * time.Millisecond,
+		RetryMax:      5 * time.Second,
+		OutboxSize:    1000,
+
+		AdminAddr: "127.0.0.1",
 	}
+}
 
-	if gorutineCount < 0 {
-		return nil, fmt.Errorf("GORUTINE_COUNT must be > 0")
+// Validate проверяет связанные настройки.
+func (cfg *Config) Validate() error {
+	if cfg.RetryMax < cfg.RetryBase {
+		return fmt.Errorf("config key \"retry_max\" must be >= \"retry_base\"")
 	}
 
-	flag.Parse()
+	if (len(cfg.TLSCertFile) == 0) != (len(cfg.TLSKeyFile) == 0) {
+		return fmt.Errorf("config keys \"tls_client_cert_file\" and \"tls_client_key_file\" must be set together")
+	}
 
-	hostname := flag.String("h", "localhost", "orchestrator adress")
-	port := flag.Int("p", 8081, "orchestrator port")
+	if len(cfg.TLSCertFile) != 0 && !cfg.TLS {
+		return fmt.Errorf("config key \"tls_client_cert_file\" requires \"tls\"")
+	}
 
-	if *port < 0 {
-		return nil, fmt.Errorf("port must be > 0")
+	if len(cfg.AgentID) == 0 {
+		return fmt.Errorf("config key \"agent_id\" must not be empty")
 	}
 
-	agcfg := Config{
-		GorutineCount: gorutineCount,
-		Hostname:      *hostname,
-		Port:          *port,
+	return nil
+}
+
+// NewConfigAg собирает конфигурацию из файла, окружения и флагов.
+func NewConfigAg() (*Config, error) {
+	agcfg := defaultConfig()
+	if err := settings.Load(&agcfg, "agent", os.Args[1:]); err != nil {
+		return nil, err
 	}
 
 	return &agcfg, nil
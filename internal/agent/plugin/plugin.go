@@ -0,0 +1,259 @@
+// Package plugin запускает внешние исполнители пользовательских операций.
+//
+// Исполнитель - любая программа, которая читает запросы из stdin и пишет
+// ответы в stdout, по одному JSON-объекту на строку:
+//
+//	-> {"id": 1, "op": "npv", "args": [0.1, 100, 200]}
+//	<- {"id": 1, "result": 256.198347}
+//	<- {"id": 1, "error": "rate must be > -1"}
+//
+// Запросы к одному исполнителю отправляются по очереди. Если исполнитель
+// не ответил вовремя или завершился, он перезапускается при следующем вызове.
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/backoff"
+)
+
+// Config - описание исполнителя в файле PLUGINS_FILE
+type Config struct {
+	Name       string            `json:"name"`
+	Command    []string          `json:"command"`
+	Operations []OperationConfig `json:"operations"`
+
+	TimeoutMs  int `json:"timeout_ms"`  // время на один вызов, по умолчанию 2 секунды
+	MemoryKB   int `json:"memory_kb"`   // ulimit -v, 0 - без ограничения
+	CPUSeconds int `json:"cpu_seconds"` // ulimit -t, 0 - без ограничения
+}
+
+// OperationConfig - функция, которую выполняет исполнитель
+type OperationConfig struct {
+	Symbol     string `json:"symbol"`
+	Arity      int    `json:"arity"`
+	DurationMs int    `json:"duration_ms"` // задержка перед вызовом, как у TIME_*_MS
+}
+
+// Load читает описания исполнителей из JSON-файла.
+func Load(path string) ([]Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read plugins file: %w", err)
+	}
+
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("parse plugins file: %w", err)
+	}
+
+	for _, cfg := range configs {
+		if len(cfg.Command) == 0 {
+			return nil, fmt.Errorf("plugin %q: empty command", cfg.Name)
+		}
+		if len(cfg.Operations) == 0 {
+			return nil, fmt.Errorf("plugin %q: no operations", cfg.Name)
+		}
+		if cfg.TimeoutMs < 0 || cfg.MemoryKB < 0 || cfg.CPUSeconds < 0 {
+			return nil, fmt.Errorf("plugin %q: limits must be non-negative", cfg.Name)
+		}
+	}
+
+	return configs, nil
+}
+
+type request struct {
+	ID   int64     `json:"id"`
+	Op   string    `json:"op"`
+	Args []float64 `json:"args"`
+}
+
+type response struct {
+	ID     int64   `json:"id"`
+	Result float64 `json:"result"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Plugin - запущенный исполнитель
+type Plugin struct {
+	cfg     Config
+	timeout time.Duration
+	logger  *log.Logger
+
+	locker    sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	responses chan response // закрывается, когда исполнитель завершился
+	nextID    int64
+	crashes   int // падения подряд, задают паузу перед перезапуском
+	closed    bool
+}
+
+func New(cfg Config, logger *log.Logger) *Plugin {
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+
+	return &Plugin{
+		cfg:     cfg,
+		timeout: timeout,
+		logger:  logger,
+	}
+}
+
+// пауза перед перезапуском после падений подряд
+var restartBackoff = backoff.Backoff{Base: 100 * time.Millisecond, Max: 5 * time.Second}
+
+// Call выполняет операцию в исполнителе.
+func (p *Plugin) Call(op string, args []float64) (float64, error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	if p.closed {
+		return 0, fmt.Errorf("plugin %q is closed", p.cfg.Name)
+	}
+
+	if p.cmd == nil {
+		if p.crashes > 0 {
+			time.Sleep(restartBackoff.Delay(p.crashes - 1))
+		}
+		if err := p.start(); err != nil {
+			p.crashes++
+			return 0, err
+		}
+	}
+
+	p.nextID++
+	req := request{ID: p.nextID, Op: op, Args: args}
+	line, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := p.stdin.Write(append(line, '\n')); err != nil {
+		p.restart("write error: %v", err)
+		return 0, fmt.Errorf("plugin %q: %w", p.cfg.Name, err)
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case resp, ok := <-p.responses:
+			if !ok {
+				p.restart("exited")
+				return 0, fmt.Errorf("plugin %q exited", p.cfg.Name)
+			}
+			// ответ на запрос, который уже не ждут
+			if resp.ID != req.ID {
+				continue
+			}
+
+			p.crashes = 0
+			if len(resp.Error) != 0 {
+				return 0, fmt.Errorf("plugin %q: %s", p.cfg.Name, resp.Error)
+			}
+			return resp.Result, nil
+		case <-timer.C:
+			p.restart("no answer in %v", p.timeout)
+			return 0, fmt.Errorf("plugin %q: timeout", p.cfg.Name)
+		}
+	}
+}
+
+// запускаем процесс исполнителя с ограничениями ресурсов
+func (p *Plugin) start() error {
+	// ограничения задаются через ulimit в оболочке, которая затем
+	// заменяется процессом исполнителя
+	script := ""
+	if p.cfg.MemoryKB > 0 {
+		script += fmt.Sprintf("ulimit -v %d || exit 1; ", p.cfg.MemoryKB)
+	}
+	if p.cfg.CPUSeconds > 0 {
+		script += fmt.Sprintf("ulimit -t %d || exit 1; ", p.cfg.CPUSeconds)
+	}
+	script += `exec "$0" "$@"`
+
+	cmd := exec.Command("sh", append([]string{"-c", script}, p.cfg.Command...)...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start plugin %q: %w", p.cfg.Name, err)
+	}
+
+	responses := make(chan response)
+	go p.read(stdout, responses)
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.responses = responses
+	p.logger.Printf("Plugin %q started, pid %d\n", p.cfg.Name, cmd.Process.Pid)
+
+	return nil
+}
+
+// читаем ответы, пока исполнитель не закроет stdout
+func (p *Plugin) read(stdout io.Reader, responses chan<- response) {
+	defer close(responses)
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var resp response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			p.logger.Printf("Plugin %q: incorrect answer %q\n", p.cfg.Name, scanner.Text())
+			continue
+		}
+		responses <- resp
+	}
+}
+
+// останавливаем исполнитель, следующий вызов запустит его заново
+func (p *Plugin) restart(reason string, args ...any) {
+	p.logger.Printf("Plugin %q: %s, restarting\n", p.cfg.Name, fmt.Sprintf(reason, args...))
+	p.crashes++
+	p.stop()
+}
+
+func (p *Plugin) stop() {
+	if p.cmd == nil {
+		return
+	}
+
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	// дочитываем stdout, чтобы читающая горутина завершилась
+	for range p.responses {
+	}
+	p.cmd.Wait()
+	p.cmd = nil
+}
+
+// Close останавливает исполнитель.
+func (p *Plugin) Close() error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.closed = true
+	p.stop()
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/roadtoseniors/apicalc/pkg/backoff"
+
+	"github.com/roadtoseniors/apicalc/internal/grpc/rpc"
+	"github.com/roadtoseniors/apicalc/internal/registration"
+	"github.com/roadtoseniors/apicalc/internal/result"
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// Client получает задачи и отправляет результаты через один поток gRPC.
+type Client struct {
+	conn    *grpc.ClientConn
+	wait    time.Duration
+	agentID string
+
+	Retry    int             // сколько раз пытаться доставить результаты
+	Backoff  backoff.Backoff // задержки между попытками
+	failures atomic.Int64    // неудачные попытки получить задачи подряд
+
+	locker  sync.Mutex
+	stream  rpc.WorkClient
+	cancel  context.CancelFunc
+	tasks   chan task.Task
+	broken  chan struct{} // закрывается, когда поток оборвался
+	granted int           // задачи, обещанные оркестратору, но ещё не полученные
+}
+
+// максимальное количество задач в пути к агенту
+const maxCredits = 100
+
+// NewClient подключается без TLS, если opts не задают другие параметры соединения.
+func NewClient(host string, port int, wait time.Duration, agentID string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, opts...)
+	conn, err := grpc.NewClient(fmt.Sprintf("%s:%d", host, port), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if wait <= 0 {
+		wait = 5 * time.Second
+	}
+
+	return &Client{
+		conn:    conn,
+		wait:    wait,
+		agentID: agentID,
+	}, nil
+}
+
+// открываем поток, если он ещё не открыт или оборвался
+func (client *Client) connect() (rpc.WorkClient, <-chan struct{}, error) {
+	client.locker.Lock()
+	defer client.locker.Unlock()
+
+	if client.stream != nil {
+		return client.stream, client.broken, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := rpc.Work(ctx, client.conn)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	client.stream = stream
+	client.cancel = cancel
+	client.tasks = make(chan task.Task, maxCredits)
+	client.broken = make(chan struct{})
+	client.granted = 0
+
+	go client.receive(stream, client.tasks, client.broken)
+
+	return stream, client.broken, nil
+}
+
+// читаем задачи из потока, пока он жив
+func (client *Client) receive(stream rpc.WorkClient, tasks chan<- task.Task, broken chan struct{}) {
+	defer close(broken)
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			client.reset(stream)
+			return
+		}
+
+		for _, t := range msg.Tasks {
+			tasks <- t
+		}
+	}
+}
+
+// забываем оборванный поток, следующий запрос откроет новый
+func (client *Client) reset(stream rpc.WorkClient) {
+	client.locker.Lock()
+	defer client.locker.Unlock()
+
+	if client.stream != stream {
+		return
+	}
+
+	client.cancel()
+	client.stream = nil
+}
+
+// отправляем сообщение, Send нельзя вызывать из нескольких горутин сразу
+func (client *Client) send(stream rpc.WorkClient, msg *rpc.AgentMessage) error {
+	client.locker.Lock()
+	defer client.locker.Unlock()
+
+	return stream.Send(msg)
+}
+
+// пауза после неудачи, растёт с каждой неудачей подряд, отмена ctx её прерывает
+func (client *Client) pause(ctx context.Context) {
+	delay := client.Backoff.Delay(int(client.failures.Add(1)) - 1)
+	if delay == 0 {
+		delay = 500 * time.Millisecond
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// GetTasks ждёт до limit задач не дольше времени ожидания или до отмены ctx.
+// Задачи, пришедшие после отмены, остаются за агентом до его ухода из реестра.
+func (client *Client) GetTasks(ctx context.Context, limit int) []task.Task {
+	stream, broken, err := client.connect()
+	if err != nil {
+		client.pause(ctx)
+		return nil
+	}
+
+	client.locker.Lock()
+	tasks := client.tasks
+	need := min(limit, maxCredits) - client.granted
+	if need > 0 {
+		err = stream.Send(&rpc.AgentMessage{AgentID: client.agentID, Credits: need})
+		client.granted += need
+	}
+	client.locker.Unlock()
+	if err != nil {
+		client.reset(stream)
+		client.pause(ctx)
+		return nil
+	}
+	client.failures.Store(0)
+
+	timer := time.NewTimer(client.wait)
+	defer timer.Stop()
+
+	var received []task.Task
+	select {
+	case t := <-tasks:
+		received = append(received, t)
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return nil
+	case <-broken:
+		client.pause(ctx)
+		return nil
+	}
+
+	// забираем то, что уже пришло
+	for drained := false; !drained && len(received) < limit; {
+		select {
+		case t := <-tasks:
+			received = append(received, t)
+		default:
+			drained = true
+		}
+	}
+
+	client.locker.Lock()
+	if client.stream == stream {
+		client.granted -= len(received)
+	}
+	client.locker.Unlock()
+
+	return received
+}
+
+// SendResults отправляет результаты в поток, при обрыве переподключается.
+func (client *Client) SendResults(results []result.Result) error {
+	_, err := backoff.Retry(client.Retry, client.Backoff, func() error {
+		stream, _, err := client.connect()
+		if err != nil {
+			return err
+		}
+
+		err = client.send(stream, &rpc.AgentMessage{AgentID: client.agentID, Results: results})
+		if err != nil {
+			client.reset(stream)
+		}
+
+		return err
+	})
+
+	return err
+}
+
+// Register регистрирует агента на оркестраторе.
+func (client *Client) Register(reg registration.Registration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return rpc.Register(ctx, client.conn, &reg)
+}
+
+// Heartbeat сообщает оркестратору, что агент жив.
+func (client *Client) Heartbeat(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return rpc.Heartbeat(ctx, client.conn, id)
+}
+
+// Deregister исключает агента из реестра.
+func (client *Client) Deregister(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return rpc.Deregister(ctx, client.conn, id)
+}
+
+// Close закрывает соединение с оркестратором.
+func (client *Client) Close() error {
+	client.locker.Lock()
+	if client.stream != nil {
+		client.stream.CloseSend()
+		client.cancel()
+		client.stream = nil
+	}
+	client.locker.Unlock()
+
+	return client.conn.Close()
+}
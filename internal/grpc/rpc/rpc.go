@@ -0,0 +1,159 @@
+// Package rpc описывает gRPC-сервис обмена задачами между агентом и оркестратором.
+//
+// Сообщения кодируются в JSON, поэтому сервис описан вручную, без protoc.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	"github.com/roadtoseniors/apicalc/internal/registration"
+	"github.com/roadtoseniors/apicalc/internal/result"
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// Codec - имя кодека сообщений, клиент передаёт его в CallContentSubtype
+const Codec = "json"
+
+const workMethod = "/apicalc.Agent/Work"
+
+// AgentMessage - сообщение агента оркестратору
+type AgentMessage struct {
+	AgentID string          `json:"agent_id,omitempty"`
+	Credits int             `json:"credits,omitempty"` // сколько ещё задач агент готов принять
+	Results []result.Result `json:"results,omitempty"`
+}
+
+// TaskMessage - задачи, отправленные агенту
+type TaskMessage struct {
+	Tasks []task.Task `json:"tasks"`
+}
+
+// AgentRef - идентификатор агента
+type AgentRef struct {
+	ID string `json:"id"`
+}
+
+// Empty - пустой ответ
+type Empty struct{}
+
+// AgentServer обслуживает регистрацию агентов и поток задач одного агента.
+type AgentServer interface {
+	Register(context.Context, *registration.Registration) (*Empty, error)
+	Heartbeat(context.Context, *AgentRef) (*Empty, error)
+	Deregister(context.Context, *AgentRef) (*Empty, error)
+	Work(grpc.BidiStreamingServer[AgentMessage, TaskMessage]) error
+}
+
+// WorkClient - поток задач на стороне агента
+type WorkClient = grpc.BidiStreamingClient[AgentMessage, TaskMessage]
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "apicalc.Agent",
+	HandlerType: (*AgentServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Register",
+			Handler:    unaryHandler("Register", AgentServer.Register),
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    unaryHandler("Heartbeat", AgentServer.Heartbeat),
+		},
+		{
+			MethodName: "Deregister",
+			Handler:    unaryHandler("Deregister", AgentServer.Deregister),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Work",
+			Handler:       workHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// обработчик унарного метода с поддержкой перехватчиков
+func unaryHandler[Req any](
+	name string,
+	method func(AgentServer, context.Context, *Req) (*Empty, error),
+) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		in := new(Req)
+		if err := dec(in); err != nil {
+			return nil, err
+		}
+
+		if interceptor == nil {
+			return method(srv.(AgentServer), ctx, in)
+		}
+
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/apicalc.Agent/" + name,
+		}
+		handler := func(ctx context.Context, req any) (any, error) {
+			return method(srv.(AgentServer), ctx, req.(*Req))
+		}
+
+		return interceptor(ctx, in, info, handler)
+	}
+}
+
+func workHandler(srv any, stream grpc.ServerStream) error {
+	return srv.(AgentServer).Work(&grpc.GenericServerStream[AgentMessage, TaskMessage]{ServerStream: stream})
+}
+
+// RegisterAgentServer регистрирует сервис на gRPC-сервере.
+func RegisterAgentServer(s grpc.ServiceRegistrar, srv AgentServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+// Register регистрирует агента на оркестраторе.
+func Register(ctx context.Context, cc grpc.ClientConnInterface, reg *registration.Registration) error {
+	return cc.Invoke(ctx, "/apicalc.Agent/Register", reg, new(Empty), grpc.CallContentSubtype(Codec))
+}
+
+// Heartbeat сообщает оркестратору, что агент жив.
+func Heartbeat(ctx context.Context, cc grpc.ClientConnInterface, id string) error {
+	return cc.Invoke(ctx, "/apicalc.Agent/Heartbeat", &AgentRef{ID: id}, new(Empty), grpc.CallContentSubtype(Codec))
+}
+
+// Deregister исключает агента из реестра.
+func Deregister(ctx context.Context, cc grpc.ClientConnInterface, id string) error {
+	return cc.Invoke(ctx, "/apicalc.Agent/Deregister", &AgentRef{ID: id}, new(Empty), grpc.CallContentSubtype(Codec))
+}
+
+// Work открывает поток задач с оркестратором.
+func Work(ctx context.Context, cc grpc.ClientConnInterface) (WorkClient, error) {
+	stream, err := cc.NewStream(ctx, &serviceDesc.Streams[0], workMethod, grpc.CallContentSubtype(Codec))
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpc.GenericClientStream[AgentMessage, TaskMessage]{ClientStream: stream}, nil
+}
+
+// кодек JSON вместо protobuf
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return Codec
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
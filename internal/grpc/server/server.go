@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/roadtoseniors/apicalc/internal/agentauth"
+	"github.com/roadtoseniors/apicalc/internal/grpc/rpc"
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+	"github.com/roadtoseniors/apicalc/internal/registration"
+	"github.com/roadtoseniors/apicalc/internal/service"
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// Run запускает gRPC-сервер для агентов.
+func Run(
+	ctx context.Context,
+	logger *log.Logger,
+	cfg config.Config,
+	calcService *service.CalcService,
+) (func(), error) {
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(cfg.ListenAddr, strconv.Itoa(cfg.GRPCPort))
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("grpc listen error: %w", err)
+	}
+
+	checker := cfg.AgentChecker()
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (any, error) {
+			if err := authorize(ctx, checker); err != nil {
+				return nil, err
+			}
+			return next(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+			if err := authorize(stream.Context(), checker); err != nil {
+				return err
+			}
+			return next(srv, stream)
+		}),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	srv := grpc.NewServer(opts...)
+	rpc.RegisterAgentServer(srv, &agentServer{
+		logger:      logger,
+		calcService: calcService,
+	})
+
+	logger.Printf("START GRPC SERVER ON %s (tls: %t)\n", addr, tlsConfig != nil)
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			logger.Printf("grpc Serve: %v\n", err)
+		}
+	}()
+
+	// GracefulStop ждал бы закрытия потоков агентов, которые живут всё время
+	return srv.Stop, nil
+}
+
+// проверяем токен из метаданных или сертификат агента
+func authorize(ctx context.Context, checker agentauth.Checker) error {
+	if !checker.Enabled() {
+		return nil
+	}
+
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(agentauth.Header); len(values) != 0 {
+			authorization = values[0]
+		}
+	}
+
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+
+	if !checker.Allow(authorization, state) {
+		return status.Error(codes.Unauthenticated, "agent authentication required")
+	}
+
+	return nil
+}
+
+type agentServer struct {
+	logger      *log.Logger
+	calcService *service.CalcService
+}
+
+// Register регистрирует агента.
+func (s *agentServer) Register(ctx context.Context, reg *registration.Registration) (*rpc.Empty, error) {
+	if err := s.calcService.RegisterAgent(*reg); err != nil {
+		code := codes.InvalidArgument
+		if errors.Is(err, service.ErrAnonymousOperations) {
+			code = codes.PermissionDenied
+		}
+		return nil, status.Error(code, err.Error())
+	}
+
+	return &rpc.Empty{}, nil
+}
+
+// Heartbeat отмечает, что агент жив.
+func (s *agentServer) Heartbeat(ctx context.Context, ref *rpc.AgentRef) (*rpc.Empty, error) {
+	if err := s.calcService.Heartbeat(ref.ID); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &rpc.Empty{}, nil
+}
+
+// Deregister исключает агента и возвращает его задачи в очередь.
+func (s *agentServer) Deregister(ctx context.Context, ref *rpc.AgentRef) (*rpc.Empty, error) {
+	if _, err := s.calcService.DeregisterAgent(ref.ID); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	return &rpc.Empty{}, nil
+}
+
+// Work принимает результаты агента и отправляет ему задачи,
+// пока у агента есть свободные воркеры.
+func (s *agentServer) Work(stream grpc.BidiStreamingServer[rpc.AgentMessage, rpc.TaskMessage]) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	// сколько ещё задач агент готов принять
+	var credits atomic.Int64
+	// агент представляется в сообщениях потока
+	var agentID atomic.Value
+	agentID.Store("")
+	moreCredits := make(chan struct{}, 1)
+	recvErr := make(chan error, 1)
+
+	go func() {
+		defer cancel()
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			if len(msg.AgentID) != 0 {
+				agentID.Store(msg.AgentID)
+			}
+
+			s.putResults(msg)
+
+			if msg.Credits > 0 {
+				credits.Add(int64(msg.Credits))
+				select {
+				case moreCredits <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	for {
+		available := int(credits.Load())
+		id := agentID.Load().(string)
+
+		// ждём, пока агент не представится и не сообщит о свободных воркерах:
+		// задачи анонимного потока потом некому вернуть
+		if available == 0 || len(id) == 0 {
+			select {
+			case <-moreCredits:
+				continue
+			case <-ctx.Done():
+				return streamError(ctx, recvErr)
+			}
+		}
+
+		tasks := s.calcService.WaitTasks(ctx, id, available)
+		if len(tasks) == 0 {
+			if ctx.Err() != nil {
+				return streamError(ctx, recvErr)
+			}
+			continue
+		}
+
+		msg := rpc.TaskMessage{Tasks: make([]task.Task, 0, len(tasks))}
+		ids := make([]int64, 0, len(tasks))
+		for _, t := range tasks {
+			msg.Tasks = append(msg.Tasks, *t)
+			ids = append(ids, t.ID)
+		}
+
+		// поток закрылся, пока ждали задачи, или задачи не ушли:
+		// отдаём их другим агентам, не дожидаясь таймаутов
+		if ctx.Err() != nil {
+			s.calcService.ReleaseTasks(id, ids)
+			return streamError(ctx, recvErr)
+		}
+		if err := stream.Send(&msg); err != nil {
+			s.calcService.ReleaseTasks(id, ids)
+			return err
+		}
+		credits.Add(-int64(len(tasks)))
+	}
+}
+
+// сохраняем результаты, пришедшие от агента
+func (s *agentServer) putResults(msg *rpc.AgentMessage) {
+	for _, res := range msg.Results {
+		value, err := strconv.ParseFloat(res.Value, 64)
+		if err == nil {
+			err = s.calcService.PutResult(res.ID, value)
+		}
+		if err != nil {
+			s.logger.Printf("grpc result %d rejected: %v\n", res.ID, err)
+		}
+	}
+}
+
+// причина завершения потока: агент закрыл поток или истёк контекст
+func streamError(ctx context.Context, recvErr <-chan error) error {
+	select {
+	case err := <-recvErr:
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	default:
+		return ctx.Err()
+	}
+}
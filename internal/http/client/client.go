@@ -5,39 +5,138 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/roadtoseniors/apicalc/pkg/backoff"
+
+	"github.com/roadtoseniors/apicalc/internal/agentauth"
+	"github.com/roadtoseniors/apicalc/internal/registration"
 	"github.com/roadtoseniors/apicalc/internal/result"
 	"github.com/roadtoseniors/apicalc/internal/task"
 )
 
+// пауза между опросами пустой очереди без долгого опроса
+const idlePause = 500 * time.Millisecond
+
 type Client struct {
 	http.Client
 	Host string
 	Port int
+	TLS  bool          // обращаться к оркестратору по HTTPS
+	Wait time.Duration // сколько оркестратор держит запрос задачи при пустой очереди
+
+	AgentID string // за этим агентом оркестратор закрепляет выданные задачи
+	Token   string // общий токен агентов, пусто - не отправляется
+
+	Retry    int             // сколько раз пытаться доставить результаты
+	Backoff  backoff.Backoff // задержки между попытками
+	failures atomic.Int64    // неудачные запросы задач подряд
+}
+
+// адрес маршрута оркестратора
+func (client *Client) url(path string) string {
+	scheme := "http"
+	if client.TLS {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(client.Host, strconv.Itoa(client.Port)), path)
+}
+
+// запрос к оркестратору с токеном агента
+func (client *Client) newRequest(method, requesturl string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, requesturl, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(client.Token) != 0 {
+		req.Header.Set(agentauth.Header, agentauth.Bearer(client.Token))
+	}
+
+	return req, nil
+}
+
+// пауза после неудачного запроса задач, растёт с каждой неудачей подряд
+func (client *Client) pause(ctx context.Context) {
+	delay := client.Backoff.Delay(int(client.failures.Add(1)) - 1)
+	if delay == 0 {
+		delay = 500 * time.Millisecond
+	}
+
+	sleep(ctx, delay)
+}
+
+// без долгого опроса пустая очередь отвечает сразу, не опрашиваем её непрерывно
+func (client *Client) idle(ctx context.Context) {
+	if client.Wait <= 0 {
+		sleep(ctx, idlePause)
+	}
+}
+
+// пауза, которую прерывает отмена ctx
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// ошибка ответа оркестратора, повторять стоит только при ошибках сервера
+func statusError(resp *http.Response) error {
+	err := fmt.Errorf("unexpected status: %s", resp.Status)
+	if resp.StatusCode < http.StatusInternalServerError {
+		return backoff.Permanent(err)
+	}
+
+	return err
 }
 
 // запрашивам таску у оркестратора.
 func (client *Client) GetTask() *task.Task {
-	requesturl := fmt.Sprintf("http://%s:%d/internal/task", client.Host, client.Port)
+	query := url.Values{}
+	if client.Wait > 0 {
+		query.Set("wait", client.Wait.String())
+	}
+	if len(client.AgentID) != 0 {
+		query.Set("agent", client.AgentID)
+	}
+
+	requesturl := client.url("/internal/task") + "?" + query.Encode()
 
-	req, err := http.NewRequest(http.MethodGet, requesturl, nil)
+	req, err := client.newRequest(http.MethodGet, requesturl, nil)
 	if err != nil {
 		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second+client.Wait)
 	defer cancel()
 
 	compreq, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		time.Sleep(500 * time.Millisecond)
+		client.pause(context.Background())
 		return nil
 	}
 	defer compreq.Body.Close()
 
+	// без доступа повторять сразу бесполезно
+	if compreq.StatusCode == http.StatusUnauthorized {
+		client.pause(context.Background())
+		return nil
+	}
+	client.failures.Store(0)
+
 	if compreq.StatusCode != http.StatusOK {
+		client.idle(context.Background())
 		return nil
 	}
 
@@ -54,22 +153,148 @@ func (client *Client) GetTask() *task.Task {
 }
 
 // отправлям результат выполнения задачи оркестратору.
-func (client *Client) SendResult(result result.Result) {
-	var buf bytes.Buffer
+func (client *Client) SendResult(result result.Result) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
 
-	encoder := json.NewEncoder(&buf)
-	encoder.SetIndent("", "    ")
+	requesturl := client.url("/internal/task")
 
-	err := encoder.Encode(result)
+	return client.post(requesturl, body)
+}
+
+// запрашиваем у оркестратора до limit задач за раз.
+// Отмена ctx прерывает долгий опрос.
+func (client *Client) GetTasks(ctx context.Context, limit int) []task.Task {
+	query := url.Values{}
+	query.Set("max", strconv.Itoa(limit))
+	if client.Wait > 0 {
+		query.Set("wait", client.Wait.String())
+	}
+	if len(client.AgentID) != 0 {
+		query.Set("agent", client.AgentID)
+	}
+
+	requesturl := client.url("/internal/tasks") + "?" + query.Encode()
+
+	req, err := client.newRequest(http.MethodGet, requesturl, nil)
 	if err != nil {
-		return
+		return nil
 	}
 
-	requesturl := fmt.Sprintf("http://%s:%d/internal/task", client.Host, client.Port)
+	reqctx, cancel := context.WithTimeout(ctx, 5*time.Second+client.Wait)
+	defer cancel()
 
-	reqhttp, err := http.NewRequest(http.MethodPost, requesturl, &buf)
+	compreq, err := client.Do(req.WithContext(reqctx))
 	if err != nil {
-		return
+		client.pause(ctx)
+		return nil
+	}
+	defer compreq.Body.Close()
+
+	// без доступа повторять сразу бесполезно
+	if compreq.StatusCode == http.StatusUnauthorized {
+		client.pause(ctx)
+		return nil
+	}
+	client.failures.Store(0)
+
+	if compreq.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	answer := struct {
+		Tasks []task.Task `json:"tasks"`
+	}{}
+
+	err = json.NewDecoder(compreq.Body).Decode(&answer)
+	if err != nil {
+		return nil
+	}
+	if len(answer.Tasks) == 0 {
+		client.idle(ctx)
+	}
+
+	return answer.Tasks
+}
+
+// отправляем оркестратору пачку результатов.
+func (client *Client) SendResults(results []result.Result) error {
+	batch := struct {
+		Results []result.Result `json:"results"`
+	}{
+		Results: results,
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	requesturl := client.url("/internal/results")
+
+	return client.post(requesturl, body)
+}
+
+// отправляем результаты, повторяя попытки с растущей задержкой
+func (client *Client) post(requesturl string, body []byte) error {
+	_, err := backoff.Retry(client.Retry, client.Backoff, func() error {
+		reqhttp, err := client.newRequest(http.MethodPost, requesturl, bytes.NewReader(body))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		compreq, err := client.Do(reqhttp.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer compreq.Body.Close()
+
+		if compreq.StatusCode != http.StatusOK {
+			return statusError(compreq)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// регистрируем агента на оркестраторе.
+func (client *Client) Register(reg registration.Registration) error {
+	body, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+
+	requesturl := client.url("/internal/agents")
+
+	return client.call(http.MethodPost, requesturl, bytes.NewReader(body), http.StatusCreated)
+}
+
+// сообщаем оркестратору, что агент жив.
+func (client *Client) Heartbeat(id string) error {
+	requesturl := client.url("/internal/agents/" + url.PathEscape(id) + "/heartbeat")
+
+	return client.call(http.MethodPost, requesturl, nil, http.StatusOK)
+}
+
+// исключаем агента из реестра оркестратора.
+func (client *Client) Deregister(id string) error {
+	requesturl := client.url("/internal/agents/" + url.PathEscape(id))
+
+	return client.call(http.MethodDelete, requesturl, nil, http.StatusNoContent)
+}
+
+// запрос к оркестратору, которому важен только код ответа
+func (client *Client) call(method, requesturl string, body io.Reader, want int) error {
+	reqhttp, err := client.newRequest(method, requesturl, body)
+	if err != nil {
+		return err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -77,7 +302,13 @@ func (client *Client) SendResult(result result.Result) {
 
 	compreq, err := client.Do(reqhttp.WithContext(ctx))
 	if err != nil {
-		return
+		return err
 	}
 	defer compreq.Body.Close()
+
+	if compreq.StatusCode != want {
+		return fmt.Errorf("unexpected status: %s", compreq.Status)
+	}
+
+	return nil
 }
@@ -0,0 +1,81 @@
+package handler_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/agentauth"
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+)
+
+// маршруты /admin требуют токен администратора, без admin_token закрыты
+func TestAdminRoutesRequireToken(t *testing.T) {
+	key := map[string]any{"name": "ci", "scopes": []string{"read"}}
+
+	tests := []struct {
+		name          string
+		method, path  string
+		body          any
+		token         string // admin_token
+		authorization string
+		status        int
+	}{
+		{"keys without header", "POST", "/admin/keys", key, "admin-secret", "", http.StatusUnauthorized},
+		{"keys with wrong token", "POST", "/admin/keys", key, "admin-secret", agentauth.Bearer("guess"), http.StatusUnauthorized},
+		{"keys with agent token", "POST", "/admin/keys", key, "admin-secret", agentauth.Bearer("agent-secret"), http.StatusUnauthorized},
+		{"keys without admin_token", "POST", "/admin/keys", key, "", agentauth.Bearer(""), http.StatusUnauthorized},
+		{"keys with admin token", "POST", "/admin/keys", key, "admin-secret", agentauth.Bearer("admin-secret"), http.StatusCreated},
+		{"key list without header", "GET", "/admin/keys", nil, "admin-secret", "", http.StatusUnauthorized},
+		{"revoke without header", "DELETE", "/admin/keys/k1", nil, "admin-secret", "", http.StatusUnauthorized},
+		{"cache without header", "GET", "/admin/cache", nil, "admin-secret", "", http.StatusUnauthorized},
+		{"cache with agent token", "GET", "/admin/cache", nil, "admin-secret", agentauth.Bearer("agent-secret"), http.StatusUnauthorized},
+		{"cache with admin token", "GET", "/admin/cache", nil, "admin-secret", agentauth.Bearer("admin-secret"), http.StatusOK},
+		{"config without header", "GET", "/admin/config", nil, "admin-secret", "", http.StatusUnauthorized},
+		{"config update without header", "PUT", "/admin/config", map[string]any{"cache_size": 1}, "admin-secret", "", http.StatusUnauthorized},
+		{"config with admin token", "GET", "/admin/config", nil, "admin-secret", agentauth.Bearer("admin-secret"), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAPIs(t, config.Config{AgentToken: "agent-secret", AdminToken: tt.token})
+
+			rec := doAuth(a.internal, tt.method, tt.path, tt.authorization, tt.body)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusUnauthorized && len(rec.Header().Get("WWW-Authenticate")) == 0 {
+				t.Fatal("no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+// файл снимка и токены не меняются через PUT /admin/config
+func TestUpdateConfigKeepsStaticKeys(t *testing.T) {
+	a := newAPIs(t, config.Config{
+		PublicPort:   8080,
+		InternalPort: 8081,
+		GRPCPort:     8082,
+		AgentTimeout: time.Second,
+		AdminToken:   "admin-secret",
+		SnapshotFile: "snapshot.json",
+	})
+	admin := agentauth.Bearer("admin-secret")
+
+	update := map[string]any{"snapshot_file": "/etc/passwd", "admin_token": "other", "cache_size": 7}
+	rec := doAuth(a.internal, "PUT", "/admin/config", admin, update)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = doAuth(a.internal, "GET", "/admin/config", admin, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("old admin token rejected after update: status %d", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "snapshot_file: snapshot.json") || !strings.Contains(body, "cache_size: 7") {
+		t.Fatalf("unexpected config:\n%s", body)
+	}
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ErrorBody - описание ошибки для клиента
+type ErrorBody struct {
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+}
+
+// ErrorResponse - тело любого ответа с ошибкой
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+// код ошибки по статусу: "not_found", "unsupported_media_type" и т.д.
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+// отвечаем ошибкой в формате ErrorResponse
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	writeErrorDetails(w, r, status, message, nil)
+}
+
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, message string, details map[string]any) {
+	resp := ErrorResponse{
+		Error: ErrorBody{
+			Code:      errorCode(status),
+			Message:   message,
+			Details:   details,
+			RequestID: requestID(r.Context()),
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	encoder.Encode(&resp)
+}
+
+// тело запроса должно быть JSON
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeErrorDetails(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/json", map[string]any{
+			"content_type": r.Header.Get("Content-Type"),
+		})
+		return false
+	}
+
+	return true
+}
+
+// разбираем JSON из тела запроса, при ошибке отвечаем 400
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+
+	details := map[string]any{}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		err = fmt.Errorf("empty body")
+	case errors.As(err, &syntaxErr):
+		details["offset"] = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		details["field"] = typeErr.Field
+		details["offset"] = typeErr.Offset
+	}
+	if len(details) == 0 {
+		details = nil
+	}
+
+	writeErrorDetails(w, r, http.StatusBadRequest, "malformed JSON body: "+err.Error(), details)
+	return false
+}
+
+// RequestIDHeader - заголовок с идентификатором запроса
+const RequestIDHeader = "X-Request-ID"
+
+// идентификатор от клиента принимаем, только если он безопасен для логов
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// RequestID присваивает запросу идентификатор и возвращает его в заголовке ответа.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// идентификатор текущего запроса
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ответы самого мультиплексора (нет маршрута, не тот метод) тоже в JSON
+func jsonFallback(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); len(pattern) != 0 {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// узнаём статус и заголовок Allow у стандартного ответа,
+		// перенаправления на очищенный путь отдаём как есть
+		rec := &statusRecorder{header: make(http.Header)}
+		mux.ServeHTTP(rec, r)
+		if rec.status < http.StatusBadRequest {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		if allow := rec.header.Get("Allow"); len(allow) != 0 {
+			w.Header().Set("Allow", allow)
+			writeErrorDetails(w, r, rec.status, "method not allowed", map[string]any{
+				"allow": strings.Split(allow, ", "),
+			})
+			return
+		}
+		writeError(w, r, rec.status, "no route for "+r.Method+" "+r.URL.Path)
+	})
+}
+
+// ответ, от которого нужны только статус и заголовки
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (rec *statusRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
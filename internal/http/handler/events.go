@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/service"
+	"github.com/roadtoseniors/apicalc/internal/userauth"
+)
+
+// как часто поток без событий шлёт комментарий, чтобы прокси не закрыли соединение
+const keepAliveInterval = 15 * time.Second
+
+// поток событий одного выражения, закрывается после done, error или cancelled
+func (cs *calcStates) expressionEvents(w http.ResponseWriter, r *http.Request) {
+	cs.streamEvents(w, r, r.PathValue("id"))
+}
+
+// поток событий всех выражений пользователя
+func (cs *calcStates) allEvents(w http.ResponseWriter, r *http.Request) {
+	cs.streamEvents(w, r, "")
+}
+
+// отдаём события выражений в формате Server-Sent Events
+func (cs *calcStates) streamEvents(w http.ResponseWriter, r *http.Request, id string) {
+	defer r.Body.Close()
+
+	sub, current, err := cs.CalcService.Subscribe(userauth.User(r.Context()), id)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	defer sub.Close()
+
+	// поток живёт дольше, чем таймаут записи сервера
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if current != nil {
+		event := service.Event{Type: service.EventSnapshot, Expression: *current}
+		if writeEvent(w, event) != nil || finished(*current) {
+			rc.Flush()
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			// подписчик не успевал читать, клиент переподключится и получит snapshot
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			if len(id) != 0 && finished(event.Expression) {
+				rc.Flush()
+				return
+			}
+		}
+
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// событие SSE: тип в поле event, JSON в поле data
+func writeEvent(w http.ResponseWriter, event service.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// выражение больше не изменится
+func finished(expr service.Expression) bool {
+	return expr.Status != service.StatusInProcess
+}
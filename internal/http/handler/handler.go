@@ -3,39 +3,124 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"slices"
 	"strconv"
+	"time"
 
+	"github.com/roadtoseniors/apicalc/internal/agentauth"
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+	"github.com/roadtoseniors/apicalc/internal/registration"
 	"github.com/roadtoseniors/apicalc/internal/result"
 	"github.com/roadtoseniors/apicalc/internal/service"
 	"github.com/roadtoseniors/apicalc/internal/task"
+	"github.com/roadtoseniors/apicalc/internal/userauth"
+	"github.com/roadtoseniors/apicalc/pkg/settings"
+	"gopkg.in/yaml.v3"
 )
 
 type Decorator func(http.Handler) http.Handler
 
 type calcStates struct {
 	CalcService *service.CalcService
+	Config      *config.Store
+	Users       userauth.Issuer
+	Admin       bool // маршруты администрирования видят ключи всех владельцев
 }
 
-func NewHandler(
+// NewPublicHandler - пользовательский API.
+func NewPublicHandler(
 	ctx context.Context,
 	calcService *service.CalcService,
+	store *config.Store,
 ) (http.Handler, error) {
 
 	serveMux := http.NewServeMux()
 
+	cfg := store.Get()
 	calcState := calcStates{
 		CalcService: calcService,
+		Config:      store,
+		Users: userauth.Issuer{
+			Secret: []byte(cfg.JWTSecret),
+			TTL:    cfg.JWTTTL,
+		},
 	}
 
-	serveMux.HandleFunc("POST /api/v1/calculate", calcState.calculate)
-	serveMux.HandleFunc("GET /api/v1/expressions", calcState.listAll)
-	serveMux.HandleFunc("GET /api/v1/expressions/{id}", calcState.listByID)
-	serveMux.HandleFunc("GET /internal/task", calcState.sendTask)
-	serveMux.HandleFunc("POST /internal/task", calcState.receiveResult)
+	// маршрут доступен пользователю или ключу с правом scope
+	route := func(pattern, scope string, h http.HandlerFunc) {
+		serveMux.Handle(pattern, Decorate(h, calcState.authenticate(scope)))
+	}
+
+	// с секретом выражения видны только их владельцам
+	if calcState.usersEnabled() {
+		serveMux.HandleFunc("POST /api/v1/register", calcState.register)
+		serveMux.HandleFunc("POST /api/v1/login", calcState.login)
+
+		route("POST /api/v1/keys", service.ScopeAdmin, calcState.createKey)
+		route("GET /api/v1/keys", service.ScopeAdmin, calcState.listKeys)
+		route("DELETE /api/v1/keys/{id}", service.ScopeAdmin, calcState.revokeKey)
+	}
 
-	return serveMux, nil
+	route("POST /api/v1/calculate", service.ScopeSubmit, calcState.calculate)
+	route("GET /api/v1/expressions", service.ScopeRead, calcState.listAll)
+	route("GET /api/v1/expressions/{id}", service.ScopeRead, calcState.listByID)
+	route("GET /api/v1/expressions/{id}/events", service.ScopeRead, calcState.expressionEvents)
+	route("GET /api/v1/events", service.ScopeRead, calcState.allEvents)
+	route("POST /api/v1/expressions/{id}/cancel", service.ScopeSubmit, calcState.cancelExpression)
+	serveMux.Handle("GET /api/v1/ws", Decorate(http.HandlerFunc(calcState.websocket), queryCredentials, calcState.authenticate(service.ScopeRead)))
+	serveMux.HandleFunc("GET /openapi.json", serveOpenAPI)
+
+	return jsonFallback(serveMux), nil
+}
+
+// NewInternalHandler - маршруты агентов и администрирования.
+func NewInternalHandler(
+	ctx context.Context,
+	calcService *service.CalcService,
+	store *config.Store,
+) (http.Handler, error) {
+
+	serveMux := http.NewServeMux()
+
+	calcState := calcStates{
+		CalcService: calcService,
+		Config:      store,
+		Admin:       true,
+	}
+
+	// маршруты агентов доступны только агентам
+	cfg := store.Get()
+	auth := agentAuth(cfg.AgentChecker())
+	agentRoute := func(pattern string, h http.HandlerFunc) {
+		serveMux.Handle(pattern, Decorate(h, auth))
+	}
+
+	agentRoute("GET /internal/task", calcState.sendTask)
+	agentRoute("POST /internal/task", calcState.receiveResult)
+	agentRoute("GET /internal/tasks", calcState.sendTasks)
+	agentRoute("POST /internal/results", calcState.receiveResults)
+	agentRoute("GET /internal/agents", calcState.listAgents)
+	agentRoute("POST /internal/agents", calcState.registerAgent)
+	agentRoute("POST /internal/agents/{id}/heartbeat", calcState.heartbeat)
+	agentRoute("DELETE /internal/agents/{id}", calcState.deregisterAgent)
+
+	// администрирование доступно только с токеном администратора
+	admin := adminAuth(cfg.AdminToken)
+	adminRoute := func(pattern string, h http.HandlerFunc) {
+		serveMux.Handle(pattern, Decorate(h, admin))
+	}
+
+	adminRoute("GET /admin/cache", calcState.cacheStats)
+	adminRoute("GET /admin/config", calcState.showConfig)
+	adminRoute("PUT /admin/config", calcState.updateConfig)
+	adminRoute("POST /admin/keys", calcState.createKey)
+	adminRoute("GET /admin/keys", calcState.listKeys)
+	adminRoute("DELETE /admin/keys/{id}", calcState.revokeKey)
+	serveMux.HandleFunc("GET /openapi.json", serveOpenAPI)
+
+	return jsonFallback(serveMux), nil
 }
 
 // мидлвар к обработчику
@@ -49,12 +134,43 @@ func Decorate(next http.Handler, ds ...Decorator) http.Handler {
 	return decorated
 }
 
+// пропускаем запросы с токеном агентов или проверенным клиентским сертификатом
+func agentAuth(checker agentauth.Checker) Decorator {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !checker.Allow(r.Header.Get(agentauth.Header), r.TLS) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="agents"`)
+				writeError(w, r, http.StatusUnauthorized, "agent authentication required")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// пропускаем запросы с токеном администратора, без admin_token не пропускаем никого
+func adminAuth(token string) Decorator {
+	checker := agentauth.Checker{Token: token}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !checker.Enabled() || !checker.Allow(r.Header.Get(agentauth.Header), nil) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeError(w, r, http.StatusUnauthorized, "admin authentication required")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // обработка запроса на добавление нового выражения
 func (cs *calcStates) calculate(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	if !slices.Contains(r.Header["Content-Type"], "application/json") {
-		http.Error(w, "Incorrect header", http.StatusUnprocessableEntity)
+	if !requireJSON(w, r) {
 		return
 	}
 
@@ -64,32 +180,42 @@ func (cs *calcStates) calculate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var expr Expression
-
-	err := json.NewDecoder(r.Body).Decode(&expr)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !decodeJSON(w, r, &expr) {
 		return
 	}
 
-	if err = cs.CalcService.AddExpression(expr.Id, expr.Expression); err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	if err := cs.CalcService.AddExpression(userauth.User(r.Context()), expr.Id, expr.Expression); err != nil {
+		status, details := submitError(err, expr.Id)
+		writeErrorDetails(w, r, status, err.Error(), details)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+// статус и подробности ошибки добавления выражения
+func submitError(err error, id string) (int, map[string]any) {
+	switch {
+	case errors.Is(err, service.ErrDraining):
+		return http.StatusServiceUnavailable, nil
+	case errors.Is(err, service.ErrDuplicateID):
+		return http.StatusConflict, map[string]any{"id": id}
+	default:
+		return http.StatusUnprocessableEntity, nil
+	}
+}
+
 // список всех выражений
 func (cs *calcStates) listAll(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	lst := cs.CalcService.ListAll()
+	lst := cs.CalcService.ListAll(userauth.User(r.Context()))
 
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "    ")
 	err := encoder.Encode(&lst)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 }
@@ -100,9 +226,9 @@ func (cs *calcStates) listByID(w http.ResponseWriter, r *http.Request) {
 
 	id := r.PathValue("id")
 
-	expr, err := cs.CalcService.FindById(id)
+	expr, err := cs.CalcService.FindById(userauth.User(r.Context()), id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, err.Error())
 		return
 	}
 
@@ -110,18 +236,91 @@ func (cs *calcStates) listByID(w http.ResponseWriter, r *http.Request) {
 	encoder.SetIndent("", "    ")
 	err = encoder.Encode(&expr)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 }
 
+// отменяем вычисление выражения
+func (cs *calcStates) cancelExpression(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	id := r.PathValue("id")
+
+	expr, err := cs.CalcService.CancelExpression(userauth.User(r.Context()), id)
+	if err != nil {
+		writeError(w, r, cancelStatus(err), err.Error())
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err = encoder.Encode(&expr)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// статус ошибки отмены: выражение не найдено или уже не вычисляется
+func cancelStatus(err error) int {
+	if errors.Is(err, service.ErrFinished) {
+		return http.StatusConflict
+	}
+
+	return http.StatusNotFound
+}
+
+// максимальное время ожидания задачи агентом
+const maxTaskWait = 30 * time.Second
+
+// время ожидания из параметра wait: длительность ("5s") или число секунд
+func parseWait(r *http.Request) (time.Duration, error) {
+	val := r.URL.Query().Get("wait")
+	if len(val) == 0 {
+		return 0, nil
+	}
+
+	wait, err := time.ParseDuration(val)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(val)
+		if convErr != nil {
+			return 0, fmt.Errorf("incorrect wait: %q", val)
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	if wait < 0 {
+		return 0, fmt.Errorf("incorrect wait: %q", val)
+	}
+
+	return min(wait, maxTaskWait), nil
+}
+
 // возвращаем таску для вычисления
 func (cs *calcStates) sendTask(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	newTask := cs.CalcService.GetTask()
+	wait, err := parseWait(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// задача закрепляется за агентом, если он представился
+	agentID := r.URL.Query().Get("agent")
+
+	var newTask *task.Task
+	if wait > 0 {
+		// долгий опрос: ждём задачу, пока агент не отключится или не выйдет время
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		newTask = cs.CalcService.WaitTask(ctx, agentID)
+		cancel()
+	} else {
+		newTask = cs.CalcService.GetTask(agentID)
+	}
 	if newTask == nil {
-		http.Error(w, "no tasks", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, "no tasks")
 		return
 	}
 
@@ -133,9 +332,9 @@ func (cs *calcStates) sendTask(w http.ResponseWriter, r *http.Request) {
 
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "    ")
-	err := encoder.Encode(&answer)
+	err = encoder.Encode(&answer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 }
@@ -145,20 +344,253 @@ func (cs *calcStates) receiveResult(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	var res result.Result
-	err := json.NewDecoder(r.Body).Decode(&res)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !decodeJSON(w, r, &res) {
 		return
 	}
 
 	value, err := strconv.ParseFloat(res.Value, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
 		return
 	}
 
 	if err = cs.CalcService.PutResult(res.ID, value); err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+}
+
+// максимальное количество задач в одном ответе
+const maxTaskBatch = 100
+
+// возвращаем пачку задач для всех свободных воркеров агента
+func (cs *calcStates) sendTasks(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	wait, err := parseWait(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit := 1
+	if val := r.URL.Query().Get("max"); len(val) != 0 {
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit <= 0 {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("incorrect max: %q", val))
+			return
+		}
+	}
+	limit = min(limit, maxTaskBatch)
+
+	agentID := r.URL.Query().Get("agent")
+
+	var tasks []*task.Task
+	if wait > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		tasks = cs.CalcService.WaitTasks(ctx, agentID, limit)
+		cancel()
+	} else {
+		tasks = cs.CalcService.GetTasks(agentID, limit)
+	}
+
+	// агент перестал ждать, пока задачи выдавались: отдаём их другим агентам
+	if len(tasks) != 0 && r.Context().Err() != nil {
+		ids := make([]int64, 0, len(tasks))
+		for _, t := range tasks {
+			ids = append(ids, t.ID)
+		}
+		cs.CalcService.ReleaseTasks(agentID, ids)
+		return
+	}
+
+	answer := struct {
+		Tasks []*task.Task `json:"tasks"`
+	}{
+		Tasks: tasks,
+	}
+	if answer.Tasks == nil {
+		answer.Tasks = []*task.Task{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err = encoder.Encode(&answer)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// обрабатываем пачку результатов
+func (cs *calcStates) receiveResults(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var batch struct {
+		Results []result.Result `json:"results"`
+	}
+	if !decodeJSON(w, r, &batch) {
+		return
+	}
+
+	type rejected struct {
+		ID    int64  `json:"id"`
+		Error string `json:"error"`
+	}
+
+	answer := struct {
+		Accepted int        `json:"accepted"`
+		Rejected []rejected `json:"rejected"`
+	}{
+		Rejected: []rejected{},
+	}
+
+	// ошибка в одном результате не мешает принять остальные
+	for _, res := range batch.Results {
+		value, err := strconv.ParseFloat(res.Value, 64)
+		if err == nil {
+			err = cs.CalcService.PutResult(res.ID, value)
+		}
+		if err != nil {
+			answer.Rejected = append(answer.Rejected, rejected{ID: res.ID, Error: err.Error()})
+			continue
+		}
+		answer.Accepted++
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err := encoder.Encode(&answer)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// регистрируем агента
+func (cs *calcStates) registerAgent(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var reg registration.Registration
+	if !decodeJSON(w, r, &reg) {
+		return
+	}
+
+	if err := cs.CalcService.RegisterAgent(reg); err != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, service.ErrAnonymousOperations) {
+			status = http.StatusForbidden
+		}
+		writeError(w, r, status, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// сигнал агента о том, что он жив
+func (cs *calcStates) heartbeat(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if err := cs.CalcService.Heartbeat(r.PathValue("id")); err != nil {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+}
+
+// агент уходит, его задачи возвращаются в очередь
+func (cs *calcStates) deregisterAgent(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, err := cs.CalcService.DeregisterAgent(r.PathValue("id")); err != nil {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// реестр живых агентов
+func (cs *calcStates) listAgents(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	lst := cs.CalcService.ListAgents()
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err := encoder.Encode(&lst)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// статистика кэша результатов
+func (cs *calcStates) cacheStats(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	stats := cs.CalcService.CacheStats()
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err := encoder.Encode(&stats)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// текущая конфигурация в формате файла конфигурации
+func (cs *calcStates) showConfig(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	cfg := cs.Config.Get()
+
+	w.Header().Set("Content-Type", "application/yaml")
+	if err := settings.Print(w, &cfg); err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// ConfigUpdate - изменения после PUT /admin/config
+type ConfigUpdate struct {
+	Applied []string `json:"applied"`
+	Ignored []string `json:"ignored,omitempty"` // меняются только перезапуском
+}
+
+// меняем настройки на ходу, тело - ключи файла конфигурации в YAML или JSON
+func (cs *calcStates) updateConfig(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var values map[string]any
+	if err := yaml.NewDecoder(r.Body).Decode(&values); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	applied, ignored, err := cs.Config.Update(func(cfg *config.Config) error {
+		return settings.Apply(cfg, values)
+	})
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	update := ConfigUpdate{
+		Applied: applied,
+		Ignored: ignored,
+	}
+	if update.Applied == nil {
+		update.Applied = []string{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(&update)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 }
@@ -0,0 +1,208 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/service"
+	"github.com/roadtoseniors/apicalc/internal/userauth"
+)
+
+// APIKeyHeader - заголовок с API-ключом
+const APIKeyHeader = "X-API-Key"
+
+// KeyRequest - параметры нового API-ключа, Owner учитывается только на /admin/keys
+type KeyRequest struct {
+	Owner  string   `json:"owner"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Rate   float64  `json:"rate"`
+	Burst  int      `json:"burst"`
+}
+
+// CreatedKey - выданный ключ, Key виден только в этом ответе
+type CreatedKey struct {
+	service.APIKey
+	Key string `json:"key"`
+}
+
+// KeyList - выданные ключи без самих ключей
+type KeyList struct {
+	Keys []service.APIKey `json:"keys"`
+}
+
+// включены ли пользователи
+func (cs *calcStates) usersEnabled() bool {
+	return len(cs.Users.Secret) != 0
+}
+
+// проверяем API-ключ или токен пользователя и запоминаем, чьи это выражения.
+// Без пользователей запросы без ключа проходят, как раньше, если не задан require_auth.
+func (cs *calcStates) authenticate(scope string) Decorator {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if secret := r.Header.Get(APIKeyHeader); len(secret) != 0 {
+				key, retryAfter, err := cs.CalcService.UseAPIKey(secret, time.Now())
+				if err != nil {
+					writeError(w, r, http.StatusUnauthorized, err.Error())
+					return
+				}
+				if !key.HasScope(scope) {
+					writeErrorDetails(w, r, http.StatusForbidden, "API key has no scope "+strconv.Quote(scope), map[string]any{
+						"required_scope": scope,
+					})
+					return
+				}
+				if retryAfter > 0 {
+					seconds := retrySeconds(retryAfter)
+					w.Header().Set("Retry-After", strconv.Itoa(seconds))
+					writeErrorDetails(w, r, http.StatusTooManyRequests, "rate limit exceeded", map[string]any{
+						"retry_after": seconds,
+					})
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(userauth.WithUser(r.Context(), key.Owner)))
+				return
+			}
+
+			if !cs.usersEnabled() {
+				if cs.Config.Get().RequireAuth {
+					w.Header().Set("WWW-Authenticate", `APIKey realm="api"`)
+					writeError(w, r, http.StatusUnauthorized, "API key required")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				writeError(w, r, http.StatusUnauthorized, "authentication required")
+				return
+			}
+
+			login, err := cs.Users.Parse(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+				writeError(w, r, http.StatusUnauthorized, err.Error())
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(userauth.WithUser(r.Context(), login)))
+		})
+	}
+}
+
+// Retry-After в целых секундах, с округлением вверх
+func retrySeconds(retryAfter time.Duration) int {
+	return int(math.Ceil(retryAfter.Seconds()))
+}
+
+// выдаём ключ: пользователю - для себя, на /admin/keys - для владельца из запроса
+func (cs *calcStates) createKey(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req KeyRequest
+	if !requireJSON(w, r) || !decodeJSON(w, r, &req) {
+		return
+	}
+
+	cfg := cs.Config.Get()
+	key := service.APIKey{
+		Owner:  req.Owner,
+		Name:   req.Name,
+		Scopes: req.Scopes,
+		Rate:   cfg.APIKeyRate,
+		Burst:  cfg.APIKeyBurst,
+	}
+	if !cs.Admin {
+		key.Owner = userauth.User(r.Context())
+	}
+	if req.Rate != 0 {
+		key.Rate = req.Rate
+	}
+	if req.Burst != 0 {
+		key.Burst = req.Burst
+	}
+	// пользователь может только понизить лимиты своего ключа
+	if !cs.Admin {
+		key.Rate = min(key.Rate, cfg.APIKeyRate)
+		key.Burst = min(key.Burst, cfg.APIKeyBurst)
+	}
+
+	key, secret, err := cs.CalcService.CreateAPIKey(key)
+	if err != nil {
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	created := CreatedKey{
+		APIKey: key,
+		Key:    secret,
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err = encoder.Encode(&created)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// список ключей: пользователю - свои, на /admin/keys - все
+func (cs *calcStates) listKeys(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	lst := KeyList{Keys: cs.CalcService.ListAPIKeys()}
+	if !cs.Admin {
+		owner := userauth.User(r.Context())
+		lst.Keys = slices.DeleteFunc(lst.Keys, func(key service.APIKey) bool {
+			return key.Owner != owner
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err := encoder.Encode(&lst)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
+
+// отзываем ключ
+func (cs *calcStates) revokeKey(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	id := r.PathValue("id")
+
+	owner := userauth.User(r.Context())
+	if cs.Admin {
+		for _, key := range cs.CalcService.ListAPIKeys() {
+			if key.ID == id {
+				owner = key.Owner
+			}
+		}
+	}
+
+	if err := cs.CalcService.RevokeAPIKey(owner, id); err != nil {
+		if errors.Is(err, service.ErrUnknownAPIKey) {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
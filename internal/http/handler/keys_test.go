@@ -0,0 +1,137 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/roadtoseniors/apicalc/internal/agentauth"
+	"github.com/roadtoseniors/apicalc/internal/http/handler"
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+	"github.com/roadtoseniors/apicalc/internal/service"
+)
+
+// пользователь не может выдать себе ключ с лимитами выше настроек, администратор может
+func TestCreateKeyLimits(t *testing.T) {
+	// newAPIs задаёт api_key_rate и api_key_burst 100
+	tests := []struct {
+		name        string
+		admin       bool
+		rate        float64
+		burst       int
+		wantRate    float64
+		wantBurst   int
+		wantCreated bool
+	}{
+		{"user defaults", false, 0, 0, 100, 100, true},
+		{"user lower limits", false, 5, 10, 5, 10, true},
+		{"user higher limits are clamped", false, 1e6, 1e6, 100, 100, true},
+		{"user negative rate", false, -1, 0, 0, 0, false},
+		{"admin higher limits", true, 1e6, 1e6, 1e6, 1e6, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAPIs(t, config.Config{JWTSecret: "secret", AdminToken: "admin-secret"})
+
+			creds := map[string]any{"login": "alice", "password": "password1"}
+			if rec := do(a.public, "POST", "/api/v1/register", creds); rec.Code != http.StatusCreated {
+				t.Fatalf("register: status %d: %s", rec.Code, rec.Body)
+			}
+			rec := do(a.public, "POST", "/api/v1/login", creds)
+			var login struct {
+				Token string `json:"token"`
+			}
+			json.Unmarshal(rec.Body.Bytes(), &login)
+
+			req := map[string]any{"owner": "alice", "scopes": []string{"read"}, "rate": tt.rate, "burst": tt.burst}
+			if tt.admin {
+				rec = doAuth(a.internal, "POST", "/admin/keys", agentauth.Bearer("admin-secret"), req)
+			} else {
+				rec = doAuth(a.public, "POST", "/api/v1/keys", "Bearer "+login.Token, req)
+			}
+
+			if !tt.wantCreated {
+				if rec.Code != http.StatusUnprocessableEntity {
+					t.Fatalf("status %d, want 422: %s", rec.Code, rec.Body)
+				}
+				return
+			}
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+
+			var key service.APIKey
+			json.Unmarshal(rec.Body.Bytes(), &key)
+			if key.Rate != tt.wantRate || key.Burst != tt.wantBurst {
+				t.Fatalf("rate %v burst %d, want %v and %d", key.Rate, key.Burst, tt.wantRate, tt.wantBurst)
+			}
+		})
+	}
+}
+
+// require_auth без пользователей пропускает только запросы с ключом
+func TestRequireAuth(t *testing.T) {
+	tests := []struct {
+		name        string
+		requireAuth bool
+		withKey     bool
+		status      int
+	}{
+		{"open API", false, false, http.StatusOK},
+		{"anonymous with require_auth", true, false, http.StatusUnauthorized},
+		{"key with require_auth", true, true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAPIs(t, config.Config{RequireAuth: tt.requireAuth, AdminToken: "admin-secret"})
+
+			req := httptest.NewRequest("GET", "/api/v1/expressions", nil)
+			if tt.withKey {
+				rec := doAuth(a.internal, "POST", "/admin/keys", agentauth.Bearer("admin-secret"),
+					map[string]any{"scopes": []string{"read"}})
+				var created handler.CreatedKey
+				json.Unmarshal(rec.Body.Bytes(), &created)
+				req.Header.Set(handler.APIKeyHeader, created.Key)
+			}
+
+			rec := httptest.NewRecorder()
+			a.public.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+// ключ сверх лимита получает 429 и Retry-After в целых секундах с округлением вверх
+func TestKeyRateLimit(t *testing.T) {
+	a := newAPIs(t, config.Config{AdminToken: "admin-secret"})
+
+	rec := doAuth(a.internal, "POST", "/admin/keys", agentauth.Bearer("admin-secret"),
+		map[string]any{"scopes": []string{"read"}, "rate": 0.5, "burst": 1})
+	var created handler.CreatedKey
+	json.Unmarshal(rec.Body.Bytes(), &created)
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/expressions", nil)
+		req.Header.Set(handler.APIKeyHeader, created.Key)
+		rec := httptest.NewRecorder()
+		a.public.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get(); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = get()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d, want 429: %s", rec.Code, rec.Body)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "2" {
+		t.Fatalf("Retry-After %q, want 2", retry)
+	}
+}
@@ -0,0 +1,19 @@
+package handler
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// описание публичного и внутреннего API, проверяется тестом на соответствие обработчикам
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// отдаём описание API
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
@@ -0,0 +1,558 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/agentauth"
+	"github.com/roadtoseniors/apicalc/internal/http/handler"
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+	"github.com/roadtoseniors/apicalc/internal/registration"
+	"github.com/roadtoseniors/apicalc/internal/result"
+	"github.com/roadtoseniors/apicalc/internal/service"
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// обработчики поверх одного сервиса, как в оркестраторе
+type apis struct {
+	public   http.Handler
+	internal http.Handler
+}
+
+func newAPIs(t *testing.T, cfg config.Config) apis {
+	t.Helper()
+
+	cfg.CoarseMaxOps = 1
+	cfg.APIKeyRate = 100
+	cfg.APIKeyBurst = 100
+	cfg.JWTTTL = time.Hour
+
+	calcService := service.NewCalcService(cfg)
+	store := config.NewStore(cfg)
+
+	public, err := handler.NewPublicHandler(context.Background(), calcService, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal, err := handler.NewInternalHandler(context.Background(), calcService, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return apis{public: public, internal: internal}
+}
+
+// обработчик, который обслуживает путь
+func (a apis) handlerFor(path string) http.Handler {
+	if strings.HasPrefix(path, "/api/") {
+		return a.public
+	}
+	return a.internal
+}
+
+func do(h http.Handler, method, path string, body any) *httptest.ResponseRecorder {
+	return doAuth(h, method, path, "", body)
+}
+
+// запрос с заголовком Authorization, пустой - без заголовка
+func doAuth(h http.Handler, method, path, authorization string, body any) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(authorization) != 0 {
+		req.Header.Set(agentauth.Header, authorization)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+type spec map[string]any
+
+// описание берём у самого обработчика, заодно проверяя маршрут
+func loadSpec(t *testing.T, h http.Handler) spec {
+	t.Helper()
+
+	rec := do(h, http.MethodGet, "/openapi.json", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json: status %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("GET /openapi.json: Content-Type %q", ct)
+	}
+
+	var doc spec
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	if doc["openapi"] != "3.1.0" {
+		t.Fatalf("openapi version %v", doc["openapi"])
+	}
+
+	return doc
+}
+
+// спускаемся по ключам документа
+func (s spec) lookup(keys ...string) (map[string]any, bool) {
+	node := map[string]any(s)
+	for _, key := range keys {
+		next, ok := node[key].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		node = next
+	}
+
+	return node, true
+}
+
+func (s spec) schema(name string) map[string]any {
+	schema, _ := s.lookup("components", "schemas", name)
+	return schema
+}
+
+// схема тела ответа операции
+func (s spec) responseSchema(t *testing.T, method, path string, status int) map[string]any {
+	t.Helper()
+
+	schema, ok := s.lookup("paths", path, strings.ToLower(method), "responses", fmt.Sprint(status), "content", "application/json", "schema")
+	if !ok {
+		t.Fatalf("%s %s: response %d is not documented", method, path, status)
+	}
+
+	return schema
+}
+
+// схема тела запроса операции
+func (s spec) requestSchema(t *testing.T, method, path string) map[string]any {
+	t.Helper()
+
+	schema, ok := s.lookup("paths", path, strings.ToLower(method), "requestBody", "content", "application/json", "schema")
+	if !ok {
+		t.Fatalf("%s %s: request body is not documented", method, path)
+	}
+
+	return schema
+}
+
+// resolve заменяет $ref на схему из components
+func (s spec) resolve(schema map[string]any) map[string]any {
+	for {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			return schema
+		}
+		schema = s.schema(strings.TrimPrefix(ref, "#/components/schemas/"))
+	}
+}
+
+// validate проверяет значение из JSON по подмножеству JSON Schema,
+// которое используется в описании API
+func (s spec) validate(schema map[string]any, value any, where string) error {
+	schema = s.resolve(schema)
+	if schema == nil {
+		return fmt.Errorf("%s: unresolved schema reference", where)
+	}
+
+	if typ, ok := schema["type"].(string); ok && !hasType(typ, value) {
+		return fmt.Errorf("%s: %v is not %s", where, value, typ)
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, value) {
+		return fmt.Errorf("%s: %v is not one of %v", where, value, enum)
+	}
+
+	switch val := value.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		for _, name := range asStrings(schema["required"]) {
+			if _, found := val[name]; !found {
+				return fmt.Errorf("%s: required property %q is missing", where, name)
+			}
+		}
+		for name, field := range val {
+			if prop, found := props[name].(map[string]any); found {
+				if err := s.validate(prop, field, where+"."+name); err != nil {
+					return err
+				}
+				continue
+			}
+
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return fmt.Errorf("%s: property %q is not documented", where, name)
+				}
+			case map[string]any:
+				if err := s.validate(extra, field, where+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				if err := s.validate(items, item, fmt.Sprintf("%s[%d]", where, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func hasType(typ string, value any) bool {
+	switch typ {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		num, ok := value.(float64)
+		return ok && num == math.Trunc(num)
+	}
+
+	return false
+}
+
+func asStrings(raw any) []string {
+	items, _ := raw.([]any)
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		out = append(out, item.(string))
+	}
+
+	return out
+}
+
+// проверяем тело ответа по схеме
+func (s spec) checkResponse(t *testing.T, rec *httptest.ResponseRecorder, method, path, route string, status int) map[string]any {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, rec.Code, status, rec.Body)
+	}
+
+	var body any
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: response is not JSON: %v", method, path, err)
+	}
+	if err := s.validate(s.responseSchema(t, method, route, status), body, "response"); err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+
+	obj, _ := body.(map[string]any)
+	return obj
+}
+
+// проверяем тело запроса по схеме, прежде чем отправить его
+func (s spec) checkRequest(t *testing.T, method, route string, body any) {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value any
+	json.Unmarshal(data, &value)
+
+	if err := s.validate(s.requestSchema(t, method, route), value, "request"); err != nil {
+		t.Fatalf("%s %s: %v", method, route, err)
+	}
+}
+
+// поле Go в JSON
+type jsonField struct {
+	typ       reflect.Type
+	omitempty bool
+}
+
+// поля, которые encoding/json пишет для типа, со встроенными структурами
+func jsonFields(typ reflect.Type) map[string]jsonField {
+	fields := make(map[string]jsonField)
+
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && len(name) == 0 {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for k, v := range jsonFields(embedded) {
+					fields[k] = v
+				}
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+
+		fields[name] = jsonField{typ: f.Type, omitempty: strings.Contains(opts, "omitempty")}
+	}
+
+	return fields
+}
+
+// тип схемы, которым encoding/json записывает тип Go
+func schemaType(typ reflect.Type) string {
+	if typ == reflect.TypeOf(time.Time{}) {
+		return "string"
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Pointer:
+		return schemaType(typ.Elem())
+	default:
+		return "object"
+	}
+}
+
+// схемы описания совпадают с типами, которые обработчики кодируют и разбирают
+func TestOpenAPISchemasMatchTypes(t *testing.T) {
+	doc := loadSpec(t, newAPIs(t, config.Config{}).public)
+
+	tests := []struct {
+		schema string
+		typ    reflect.Type
+	}{
+		{"Expression", reflect.TypeOf(service.Expression{})},
+		{"ExpressionUnit", reflect.TypeOf(service.ExpressionUnit{})},
+		{"ExpressionList", reflect.TypeOf(service.ExpressionList{})},
+		{"Task", reflect.TypeOf(task.Task{})},
+		{"Result", reflect.TypeOf(result.Result{})},
+		{"Event", reflect.TypeOf(service.Event{})},
+		{"TaskEvent", reflect.TypeOf(service.TaskEvent{})},
+		{"WSMessage", reflect.TypeOf(handler.WSMessage{})},
+		{"WSRequest", reflect.TypeOf(handler.WSRequest{})},
+		{"Registration", reflect.TypeOf(registration.Registration{})},
+		{"CustomOperation", reflect.TypeOf(registration.CustomOperation{})},
+		{"Agent", reflect.TypeOf(service.Agent{})},
+		{"AgentList", reflect.TypeOf(service.AgentList{})},
+		{"CacheStats", reflect.TypeOf(service.CacheStats{})},
+		{"APIKey", reflect.TypeOf(service.APIKey{})},
+		{"CreatedKey", reflect.TypeOf(handler.CreatedKey{})},
+		{"KeyList", reflect.TypeOf(handler.KeyList{})},
+		{"KeyRequest", reflect.TypeOf(handler.KeyRequest{})},
+		{"Credentials", reflect.TypeOf(handler.Credentials{})},
+		{"TokenResponse", reflect.TypeOf(handler.TokenResponse{})},
+		{"ConfigUpdate", reflect.TypeOf(handler.ConfigUpdate{})},
+		{"ErrorResponse", reflect.TypeOf(handler.ErrorResponse{})},
+		{"Error", reflect.TypeOf(handler.ErrorBody{})},
+	}
+
+	// только тела запросов: поля без omitempty в них можно не передавать
+	requestOnly := map[string]bool{"KeyRequest": true}
+
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			schema := doc.schema(tt.schema)
+			if schema == nil {
+				t.Fatalf("schema %s is not documented", tt.schema)
+			}
+
+			props, _ := schema["properties"].(map[string]any)
+			required := asStrings(schema["required"])
+			fields := jsonFields(tt.typ)
+
+			for name, field := range fields {
+				prop, found := props[name].(map[string]any)
+				if !found {
+					t.Errorf("field %q of %s is not documented", name, tt.typ)
+					continue
+				}
+
+				want := schemaType(field.typ)
+				got, _ := doc.resolve(prop)["type"].(string)
+				if got != want {
+					t.Errorf("property %q: type %q, but %s encodes %q", name, got, tt.typ, want)
+				}
+
+				// поля без omitempty присутствуют всегда
+				if isRequired := slices.Contains(required, name); requestOnly[tt.schema] {
+					if isRequired && field.omitempty {
+						t.Errorf("property %q: required, but omitempty", name)
+					}
+				} else if isRequired == field.omitempty {
+					t.Errorf("property %q: required is %t, but omitempty is %t", name, isRequired, field.omitempty)
+				}
+			}
+
+			for name := range props {
+				if _, found := fields[name]; !found {
+					t.Errorf("property %q is documented, but %s has no such field", name, tt.typ)
+				}
+			}
+		})
+	}
+}
+
+// у каждой описанной операции есть обработчик
+func TestOpenAPIRoutesExist(t *testing.T) {
+	a := newAPIs(t, config.Config{JWTSecret: "secret"})
+	doc := loadSpec(t, a.internal)
+
+	paths, _ := doc.lookup("paths")
+	for path, item := range paths {
+		for method := range item.(map[string]any) {
+			method = strings.ToUpper(method)
+			target := strings.ReplaceAll(path, "{id}", "missing")
+
+			h := a.handlerFor(path)
+			if path == "/openapi.json" {
+				h = a.public
+			}
+
+			rec := do(h, method, target, map[string]any{})
+			if rec.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s is documented but not routed", method, path)
+				continue
+			}
+
+			var resp handler.ErrorResponse
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if rec.Code == http.StatusNotFound && strings.HasPrefix(resp.Error.Message, "no route") {
+				t.Errorf("%s %s is documented but not routed", method, path)
+			}
+		}
+	}
+}
+
+// ответы обработчиков соответствуют описанию на всём пути выражения
+func TestHandlersFollowOpenAPI(t *testing.T) {
+	a := newAPIs(t, config.Config{AdminToken: "admin-secret"})
+	doc := loadSpec(t, a.public)
+
+	// пользователь отправляет выражение
+	calc := map[string]any{"id": "e1", "expression": "2+3*4"}
+	doc.checkRequest(t, "POST", "/api/v1/calculate", calc)
+	if rec := do(a.public, "POST", "/api/v1/calculate", calc); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /api/v1/calculate: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec := do(a.public, "GET", "/api/v1/expressions/e1", nil)
+	unit := doc.checkResponse(t, rec, "GET", "/api/v1/expressions/e1", "/api/v1/expressions/{id}", http.StatusOK)
+	if status := unit["expression"].(map[string]any)["status"]; status != service.StatusInProcess {
+		t.Fatalf("expression status %v", status)
+	}
+
+	// агент регистрируется, забирает задачи и сдаёт результаты
+	reg := registration.Registration{ID: "agent-1", Hostname: "test", Workers: 2, Subtrees: true}
+	doc.checkRequest(t, "POST", "/internal/agents", reg)
+	if rec := do(a.internal, "POST", "/internal/agents", reg); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /internal/agents: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// без проверки агентов оркестратор не узнаёт от них новые операции
+	custom := reg
+	custom.ID = "agent-2"
+	custom.Custom = []registration.CustomOperation{{Symbol: "npv", Arity: 3}}
+	rec = do(a.internal, "POST", "/internal/agents", custom)
+	doc.checkResponse(t, rec, "POST", "/internal/agents", "/internal/agents", http.StatusForbidden)
+
+	rec = do(a.internal, "GET", "/internal/agents", nil)
+	doc.checkResponse(t, rec, "GET", "/internal/agents", "/internal/agents", http.StatusOK)
+
+	rec = do(a.internal, "GET", "/internal/task?agent=agent-1", nil)
+	answer := doc.checkResponse(t, rec, "GET", "/internal/task", "/internal/task", http.StatusOK)
+	first := answer["task"].(map[string]any)
+
+	res := result.Result{ID: int64(first["id"].(float64)), Value: "12"}
+	doc.checkRequest(t, "POST", "/internal/task", res)
+	if rec := do(a.internal, "POST", "/internal/task", res); rec.Code != http.StatusOK {
+		t.Fatalf("POST /internal/task: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = do(a.internal, "GET", "/internal/tasks?max=5&agent=agent-1", nil)
+	batch := doc.checkResponse(t, rec, "GET", "/internal/tasks", "/internal/tasks", http.StatusOK)
+	tasks := batch["tasks"].([]any)
+	if len(tasks) != 1 {
+		t.Fatalf("expected one task, got %d", len(tasks))
+	}
+
+	results := map[string]any{"results": []result.Result{
+		{ID: int64(tasks[0].(map[string]any)["id"].(float64)), Value: "14"},
+		{ID: 12345, Value: "1"},
+	}}
+	doc.checkRequest(t, "POST", "/internal/results", results)
+	rec = do(a.internal, "POST", "/internal/results", results)
+	outcome := doc.checkResponse(t, rec, "POST", "/internal/results", "/internal/results", http.StatusOK)
+	if outcome["accepted"] != 1.0 {
+		t.Fatalf("accepted %v, want 1", outcome["accepted"])
+	}
+
+	// выражение вычислено, список и выражение по-прежнему по описанию
+	rec = do(a.public, "GET", "/api/v1/expressions", nil)
+	list := doc.checkResponse(t, rec, "GET", "/api/v1/expressions", "/api/v1/expressions", http.StatusOK)
+	expr := list["expressions"].([]any)[0].(map[string]any)
+	if expr["status"] != service.StatusDone || expr["result"] != "14" {
+		t.Fatalf("expression %v", expr)
+	}
+
+	rec = doAuth(a.internal, "GET", "/admin/cache", agentauth.Bearer("admin-secret"), nil)
+	doc.checkResponse(t, rec, "GET", "/admin/cache", "/admin/cache", http.StatusOK)
+
+	// ошибки в общем формате
+	rec = do(a.public, "GET", "/api/v1/expressions/missing", nil)
+	doc.checkResponse(t, rec, "GET", "/api/v1/expressions/missing", "/api/v1/expressions/{id}", http.StatusNotFound)
+
+	rec = do(a.public, "POST", "/api/v1/calculate", calc)
+	doc.checkResponse(t, rec, "POST", "/api/v1/calculate", "/api/v1/calculate", http.StatusConflict)
+
+	rec = do(a.internal, "GET", "/internal/task", nil)
+	doc.checkResponse(t, rec, "GET", "/internal/task", "/internal/task", http.StatusNotFound)
+}
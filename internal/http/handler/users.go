@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/service"
+)
+
+// Credentials - логин и пароль пользователя
+type Credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// TokenResponse - токен после входа
+type TokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// читаем логин и пароль из тела запроса
+func decodeCredentials(w http.ResponseWriter, r *http.Request) (Credentials, bool) {
+	var creds Credentials
+
+	ok := requireJSON(w, r) && decodeJSON(w, r, &creds)
+
+	return creds, ok
+}
+
+// регистрация пользователя
+func (cs *calcStates) register(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	creds, ok := decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	if err := cs.CalcService.RegisterUser(creds.Login, creds.Password); err != nil {
+		if errors.Is(err, service.ErrUserExists) {
+			writeError(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		writeError(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// вход: проверяем пароль и выдаём токен
+func (cs *calcStates) login(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	creds, ok := decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	if err := cs.CalcService.CheckPassword(creds.Login, creds.Password); err != nil {
+		writeError(w, r, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	token, expires, err := cs.Users.Issue(creds.Login, time.Now())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := TokenResponse{
+		Token:     token,
+		ExpiresAt: expires,
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	err = encoder.Encode(&resp)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+}
@@ -0,0 +1,386 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/roadtoseniors/apicalc/internal/service"
+	"github.com/roadtoseniors/apicalc/internal/userauth"
+	"github.com/roadtoseniors/apicalc/pkg/pubsub"
+)
+
+// Протокол /api/v1/ws: каждое сообщение - JSON-объект в текстовом кадре.
+//
+// Клиент отправляет WSRequest, ref - метка запроса, сервер возвращает её в ответе:
+//
+//	{"type": "submit", "ref": "1", "id": "e1", "expression": "2+2*2"}
+//	{"type": "subscribe", "ref": "2", "id": "e1"}    без id - все выражения пользователя
+//	{"type": "unsubscribe", "ref": "3", "id": "e1"}
+//	{"type": "cancel", "ref": "4", "id": "e1"}
+//
+// Сервер отправляет WSMessage:
+//
+//	{"type": "ack", "ref": "1", "id": "e1"}                      запрос выполнен
+//	{"type": "error", "ref": "1", "error": {...}}                  ошибка как в ErrorResponse
+//	{"type": "event", "id": "e1", "event": {...}}                 событие подписки, как в SSE
+//	{"type": "unsubscribed", "id": "e1", "reason": "finished"}    подписку закрыл сервер
+//
+// В событии id - выражение подписки, у подписки на все выражения его нет.
+// Подписка на одно выражение начинается с события snapshot и закрывается
+// после done, error или cancelled (reason "finished"). Клиент, который не успевает
+// читать, теряет подписку с reason "too_slow". Для API-ключа submit и cancel
+// требуют право submit, subscribe - право read, каждое сообщение расходует лимит ключа.
+// Браузер не задаёт заголовки WebSocket, поэтому токен и ключ можно передать
+// в параметрах access_token и api_key.
+
+// типы сообщений WebSocket
+const (
+	wsSubmit      = "submit"
+	wsSubscribe   = "subscribe"
+	wsUnsubscribe = "unsubscribe"
+	wsCancel      = "cancel"
+
+	wsAck          = "ack"
+	wsError        = "error"
+	wsEvent        = "event"
+	wsUnsubscribed = "unsubscribed"
+)
+
+// причины, по которым сервер закрывает подписку
+const (
+	wsReasonFinished = "finished"
+	wsReasonTooSlow  = "too_slow"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second // на запись одного кадра
+	wsPongWait   = 60 * time.Second // клиент должен ответить на ping или что-то прислать
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsMaxMessage = 64 << 10
+	wsQueue      = 64 // исходящие сообщения, которые ждут записи
+)
+
+// WSRequest - сообщение клиента
+type WSRequest struct {
+	Type       string `json:"type"`
+	Ref        string `json:"ref,omitempty"`
+	ID         string `json:"id,omitempty"`
+	Expression string `json:"expression,omitempty"`
+}
+
+// WSMessage - сообщение сервера
+type WSMessage struct {
+	Type   string         `json:"type"`
+	Ref    string         `json:"ref,omitempty"`
+	ID     string         `json:"id,omitempty"`
+	Event  *service.Event `json:"event,omitempty"`
+	Error  *ErrorBody     `json:"error,omitempty"`
+	Reason string         `json:"reason,omitempty"`
+}
+
+// ошибки рукопожатия тоже в формате ErrorResponse
+var upgrader = websocket.Upgrader{
+	Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		writeError(w, r, status, reason.Error())
+	},
+}
+
+// соединение одного клиента
+type wsSession struct {
+	cs        *calcStates
+	conn      *websocket.Conn
+	ctx       context.Context
+	owner     string
+	apiKey    string // ключ, с которым открыто соединение
+	requestID string
+	out       chan WSMessage
+
+	locker sync.Mutex
+	subs   map[string]*pubsub.Subscription[service.Event] // id выражения -> подписка, "" - все
+}
+
+// браузер не может задать заголовки WebSocket, берём токен и ключ из параметров
+func queryCredentials(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		token, key := query.Get("access_token"), query.Get("api_key")
+		if len(token) == 0 && len(key) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		if len(token) != 0 && len(r.Header.Get("Authorization")) == 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if len(key) != 0 && len(r.Header.Get(APIKeyHeader)) == 0 {
+			r.Header.Set(APIKeyHeader, key)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WebSocket для интерактивных клиентов
+func (cs *calcStates) websocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// остановка сервера отменяет контекст запроса и закрывает соединение
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	s := &wsSession{
+		cs:        cs,
+		conn:      conn,
+		ctx:       ctx,
+		owner:     userauth.User(r.Context()),
+		apiKey:    r.Header.Get(APIKeyHeader),
+		requestID: requestID(r.Context()),
+		out:       make(chan WSMessage, wsQueue),
+		subs:      make(map[string]*pubsub.Subscription[service.Event]),
+	}
+	defer s.unsubscribeAll()
+
+	go s.writeLoop(cancel)
+	s.readLoop()
+}
+
+// читаем запросы клиента, пока соединение живо
+func (s *wsSession) readLoop() {
+	s.conn.SetReadLimit(wsMaxMessage)
+	s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var req WSRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.fail("", http.StatusBadRequest, "malformed JSON message: "+err.Error(), nil)
+			continue
+		}
+
+		s.handle(req)
+	}
+}
+
+// пишем сообщения из очереди и проверяем соединение пингами
+func (s *wsSession) writeLoop(cancel context.CancelFunc) {
+	defer cancel()
+	defer s.conn.Close()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := s.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-s.ctx.Done():
+			closing := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+			s.conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(wsWriteWait))
+			return
+		}
+	}
+}
+
+// выполняем запрос теми же операциями сервиса, что и REST API
+func (s *wsSession) handle(req WSRequest) {
+	switch req.Type {
+	case wsSubmit:
+		if !s.allow(req.Ref, service.ScopeSubmit) {
+			return
+		}
+		if err := s.cs.CalcService.AddExpression(s.owner, req.ID, req.Expression); err != nil {
+			status, details := submitError(err, req.ID)
+			s.fail(req.Ref, status, err.Error(), details)
+			return
+		}
+		s.ack(req)
+	case wsCancel:
+		if !s.allow(req.Ref, service.ScopeSubmit) {
+			return
+		}
+		if _, err := s.cs.CalcService.CancelExpression(s.owner, req.ID); err != nil {
+			s.fail(req.Ref, cancelStatus(err), err.Error(), nil)
+			return
+		}
+		s.ack(req)
+	case wsSubscribe:
+		if !s.allow(req.Ref, service.ScopeRead) {
+			return
+		}
+		s.subscribe(req)
+	case wsUnsubscribe:
+		if !s.unsubscribe(req.ID) {
+			s.fail(req.Ref, http.StatusNotFound, fmt.Sprintf("no subscription to %q", req.ID), nil)
+			return
+		}
+		s.ack(req)
+	default:
+		s.fail(req.Ref, http.StatusBadRequest, fmt.Sprintf("unknown message type %q", req.Type), map[string]any{
+			"types": []string{wsSubmit, wsSubscribe, wsUnsubscribe, wsCancel},
+		})
+	}
+}
+
+// проверяем право и лимит API-ключа, у токена пользователя права на всё
+func (s *wsSession) allow(ref, scope string) bool {
+	if len(s.apiKey) == 0 {
+		return true
+	}
+
+	key, retryAfter, err := s.cs.CalcService.UseAPIKey(s.apiKey, time.Now())
+	switch {
+	case err != nil:
+		s.fail(ref, http.StatusUnauthorized, err.Error(), nil)
+	case !key.HasScope(scope):
+		s.fail(ref, http.StatusForbidden, "API key has no scope "+strconv.Quote(scope), map[string]any{
+			"required_scope": scope,
+		})
+	case retryAfter > 0:
+		s.fail(ref, http.StatusTooManyRequests, "rate limit exceeded", map[string]any{
+			"retry_after": retrySeconds(retryAfter),
+		})
+	default:
+		return true
+	}
+
+	return false
+}
+
+// подписываемся на выражение или, без id, на все выражения пользователя
+func (s *wsSession) subscribe(req WSRequest) {
+	// подписки добавляет только читающая горутина
+	s.locker.Lock()
+	_, found := s.subs[req.ID]
+	s.locker.Unlock()
+	if found {
+		s.fail(req.Ref, http.StatusConflict, fmt.Sprintf("already subscribed to %q", req.ID), nil)
+		return
+	}
+
+	sub, current, err := s.cs.CalcService.Subscribe(s.owner, req.ID)
+	if err != nil {
+		s.fail(req.Ref, http.StatusNotFound, err.Error(), nil)
+		return
+	}
+
+	s.locker.Lock()
+	s.subs[req.ID] = sub
+	s.locker.Unlock()
+
+	// подтверждение приходит раньше событий подписки
+	s.ack(req)
+	go s.forward(req.ID, sub, current)
+}
+
+// пересылаем события подписки клиенту
+func (s *wsSession) forward(id string, sub *pubsub.Subscription[service.Event], current *service.Expression) {
+	if current != nil {
+		s.send(WSMessage{Type: wsEvent, ID: id, Event: &service.Event{Type: service.EventSnapshot, Expression: *current}})
+		if finished(*current) {
+			s.end(id, sub, wsReasonFinished)
+			return
+		}
+	}
+
+	for event := range sub.C {
+		s.send(WSMessage{Type: wsEvent, ID: id, Event: &event})
+		if len(id) != 0 && finished(event.Expression) {
+			s.end(id, sub, wsReasonFinished)
+			return
+		}
+	}
+
+	// канал закрыт: клиент отписался или хаб отключил медленного подписчика
+	s.end(id, sub, wsReasonTooSlow)
+}
+
+// закрываем подписку по инициативе сервера, если клиент не отписался сам
+func (s *wsSession) end(id string, sub *pubsub.Subscription[service.Event], reason string) {
+	s.locker.Lock()
+	current := s.subs[id] == sub
+	if current {
+		delete(s.subs, id)
+	}
+	s.locker.Unlock()
+
+	sub.Close()
+	if current {
+		s.send(WSMessage{Type: wsUnsubscribed, ID: id, Reason: reason})
+	}
+}
+
+func (s *wsSession) unsubscribe(id string) bool {
+	s.locker.Lock()
+	sub, found := s.subs[id]
+	delete(s.subs, id)
+	s.locker.Unlock()
+
+	if found {
+		sub.Close()
+	}
+
+	return found
+}
+
+func (s *wsSession) unsubscribeAll() {
+	s.locker.Lock()
+	subs := s.subs
+	s.subs = make(map[string]*pubsub.Subscription[service.Event])
+	s.locker.Unlock()
+
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+func (s *wsSession) ack(req WSRequest) {
+	s.send(WSMessage{Type: wsAck, Ref: req.Ref, ID: req.ID})
+}
+
+func (s *wsSession) fail(ref string, status int, message string, details map[string]any) {
+	s.send(WSMessage{
+		Type: wsError,
+		Ref:  ref,
+		Error: &ErrorBody{
+			Code:      errorCode(status),
+			Message:   message,
+			Details:   details,
+			RequestID: s.requestID,
+		},
+	})
+}
+
+// ставим сообщение в очередь записи, пока соединение открыто
+func (s *wsSession) send(msg WSMessage) {
+	select {
+	case s.out <- msg:
+	case <-s.ctx.Done():
+	}
+}
@@ -2,59 +2,109 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
 	"github.com/roadtoseniors/apicalc/internal/http/handler"
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
 	"github.com/roadtoseniors/apicalc/internal/service"
 )
 
-// Run запускает HTTP-сервер.
+// Run запускает HTTP-серверы: пользовательский API и маршруты агентов
+// слушают разные порты.
 func Run(
 	ctx context.Context,
 	logger *log.Logger,
-	cfg config.Config,
+	store *config.Store,
+	calcService *service.CalcService,
 ) (func(context.Context) error, error) {
-	calcService := service.NewCalcService(cfg)
+	// адреса и TLS не меняются без перезапуска
+	cfg := store.Get()
 
-	muxHandler, err := newMuxHandler(ctx, logger, calcService)
+	publicHandler, err := handler.NewPublicHandler(ctx, calcService, store)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("handler initialization error: %w", err)
 	}
 
-	srv := &http.Server{
-		Addr:    ":8081",
-		Handler: muxHandler,
+	internalHandler, err := handler.NewInternalHandler(ctx, calcService, store)
+	if err != nil {
+		return nil, fmt.Errorf("handler initialization error: %w", err)
 	}
 
-	logger.Printf("START SERVER ON PORT 8081\n")
+	public, err := serve(ctx, logger, cfg, "PUBLIC", cfg.PublicPort, publicHandler)
+	if err != nil {
+		return nil, err
+	}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			logger.Printf("ListenAndServe: %v\n", err)
-		}
-	}()
+	internal, err := serve(ctx, logger, cfg, "INTERNAL", cfg.InternalPort, internalHandler)
+	if err != nil {
+		public.Close()
+		return nil, err
+	}
 
-	return srv.Shutdown, nil
+	return func(ctx context.Context) error {
+		return errors.Join(public.Shutdown(ctx), internal.Shutdown(ctx))
+	}, nil
 }
 
-// http-обработчик с мидлварами
-func newMuxHandler(
+// запускаем один сервер на своём порту
+func serve(
 	ctx context.Context,
 	logger *log.Logger,
-	calcService *service.CalcService,
-) (http.Handler, error) {
-	muxHandler, err := handler.NewHandler(ctx, calcService)
+	cfg config.Config,
+	name string,
+	port int,
+	h http.Handler,
+) (*http.Server, error) {
+	addr := net.JoinHostPort(cfg.ListenAddr, strconv.Itoa(port))
+
+	lis, err := net.Listen("tcp", addr)
 	if err != nil {
-		return nil, fmt.Errorf("handler initialization error: %w", err)
+		return nil, fmt.Errorf("%s listen error: %w", strings.ToLower(name), err)
+	}
+
+	// долгие опросы, потоки событий и WebSocket заканчиваются в начале
+	// Shutdown, иначе он ждал бы их до своего срока
+	streamCtx, stopStreams := context.WithCancel(ctx)
+
+	srv := &http.Server{
+		Handler:      handler.Decorate(h, handler.RequestID, loggingMiddleware(logger)),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		// отмена ctx прерывает долгие опросы агентов
+		BaseContext: func(net.Listener) context.Context { return streamCtx },
 	}
+	srv.RegisterOnShutdown(stopStreams)
 
-	muxHandler = handler.Decorate(muxHandler, loggingMiddleware(logger))
+	// сертификат загружаем сразу, чтобы ошибка остановила запуск
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		lis.Close()
+		return nil, err
+	}
+	secure := tlsConfig != nil
+	if secure {
+		srv.TLSConfig = tlsConfig
+		lis = tls.NewListener(lis, srv.TLSConfig)
+	}
 
-	return muxHandler, nil
+	logger.Printf("START %s SERVER ON %s (tls: %t)\n", name, addr, secure)
+
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			logger.Printf("%s Serve: %v\n", name, err)
+		}
+	}()
+
+	return srv, nil
 }
 
 // мидлвары для логирования запросов
@@ -65,17 +115,28 @@ func loggingMiddleware(logger *log.Logger) func(next http.Handler) http.Handler
 
 			next.ServeHTTP(w, r)
 
-			if r.URL.Path == "/internal/task" && r.Method == "GET" {
+			// агенты опрашивают очередь постоянно, не засоряем лог
+			if isPolling(r) {
 				return
 			}
 
 			duration := time.Since(start)
 			logger.Printf(
-				"HTTP request - method: %s, path: %s, duration: %d\n",
+				"HTTP request - method: %s, path: %s, duration: %d, request_id: %s\n",
 				r.Method,
 				r.URL.Path,
 				duration,
+				w.Header().Get(handler.RequestIDHeader),
 			)
 		})
 	}
 }
+
+// регулярные запросы агентов: опрос очереди и сигналы о том, что агент жив
+func isPolling(r *http.Request) bool {
+	if r.Method == "GET" {
+		return r.URL.Path == "/internal/task" || r.URL.Path == "/internal/tasks"
+	}
+
+	return r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/heartbeat")
+}
@@ -2,21 +2,29 @@ package application
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	grpcserver "github.com/roadtoseniors/apicalc/internal/grpc/server"
 	"github.com/roadtoseniors/apicalc/internal/http/server"
 	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+	"github.com/roadtoseniors/apicalc/internal/service"
 )
 
 type Application struct {
-	cfg config.Config
+	cfg   config.Config
+	store *config.Store
 }
 
 func NewApplication(cfg *config.Config) *Application {
 	return &Application{
-		cfg: *cfg,
+		cfg:   *cfg,
+		store: config.NewStore(*cfg),
 	}
 }
 
@@ -27,22 +35,162 @@ func (orch *Application) Run(ctx context.Context) int {
 		log.Ldate|log.Ltime|log.Lmsgprefix,
 	)
 
-	shutDownFunc, err := server.Run(ctx, logger, orch.cfg)
+	calcService := service.NewCalcService(orch.cfg)
+
+	// изменения конфигурации по SIGHUP и PUT /admin/config
+	orch.store.OnChange(func(cfg config.Config, applied, ignored []string) {
+		calcService.Reconfigure(cfg)
+
+		if len(applied) == 0 && len(ignored) == 0 {
+			logger.Printf("Config reloaded, no changes\n")
+		}
+		for _, change := range applied {
+			logger.Printf("Config reloaded: %s\n", change)
+		}
+		for _, change := range ignored {
+			logger.Printf("Config change needs restart, ignored: %s\n", change)
+		}
+	})
+
+	// серверы живут до конца остановки, а не до сигнала
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	defer stopServing()
+
+	shutDownFunc, err := server.Run(serveCtx, logger, orch.store, calcService)
 	if err != nil {
 		logger.Printf("Run server error: %v\n", err)
 		return 1
 	}
 
+	// gRPC работает рядом с HTTP API на отдельном порту
+	stopGRPC, err := grpcserver.Run(serveCtx, logger, orch.cfg, calcService)
+	if err != nil {
+		logger.Printf("Run grpc server error: %v\n", err)
+		return 1
+	}
+	defer stopGRPC()
+
+	go orch.expireAgents(serveCtx, logger, calcService)
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	ctx, cancel := context.WithCancel(context.Background())
+wait:
+	for {
+		select {
+		case <-hup:
+			orch.reload(logger)
+		case <-c:
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	cfg := orch.store.Get()
+	logger.Printf("Shutting down, deadline %v\n", cfg.ShutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
-	<-c
+	// новые выражения получают 503, агенты продолжают сдавать результаты
+	calcService.Drain()
+	if err := calcService.WaitIdle(ctx); err != nil {
+		logger.Printf("Shutdown deadline exceeded\n")
+	}
+
+	exitCode := 0
+	if err := orch.saveUnfinished(logger, calcService.Unfinished()); err != nil {
+		logger.Printf("Snapshot error: %v\n", err)
+		exitCode = 1
+	}
+
+	// у серверов свой срок: ожидание выражений могло исчерпать общий
+	httpCtx, cancelHTTP := context.WithTimeout(context.Background(), cfg.HTTPShutdownTimeout)
+	defer cancelHTTP()
 
-	cancel()
-	shutDownFunc(ctx)
+	// начатые запросы дописываются, долгие опросы и потоки событий серверы
+	// прерывают сами, остальное останавливаем после них
+	if err := shutDownFunc(httpCtx); err != nil {
+		logger.Printf("HTTP shutdown error: %v\n", err)
+	}
+	stopServing()
+
+	return exitCode
+}
 
-	return 0
+// сохраняем или хотя бы логируем незавершённые выражения
+func (orch *Application) saveUnfinished(logger *log.Logger, unfinished []service.ExpressionSnapshot) error {
+	for _, snapshot := range unfinished {
+		logger.Printf(
+			"Unfinished expression %q: %s, tokens: %s\n",
+			snapshot.ID,
+			snapshot.Source,
+			strings.Join(snapshot.Tokens, " "),
+		)
+	}
+
+	snapshotFile := orch.store.Get().SnapshotFile
+	if len(snapshotFile) == 0 || len(unfinished) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(unfinished, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(snapshotFile, data, 0o644); err != nil {
+		return err
+	}
+
+	logger.Printf("%d unfinished expressions saved to %s\n", len(unfinished), snapshotFile)
+
+	return nil
+}
+
+// перечитываем файл конфигурации и окружение
+func (orch *Application) reload(logger *log.Logger) {
+	_, _, err := orch.store.Update(func(cfg *config.Config) error {
+		fresh, err := config.NewConfigOrch()
+		if err != nil {
+			return err
+		}
+		*cfg = *fresh
+		return nil
+	})
+	if err != nil {
+		logger.Printf("Config reload error, keeping the current config: %v\n", err)
+	}
+}
+
+// исключаем агентов, переставших присылать сигналы, и возвращаем их задачи в очередь
+func (orch *Application) expireAgents(ctx context.Context, logger *log.Logger, calcService *service.CalcService) {
+	agentTimeout := orch.store.Get().AgentTimeout
+	ticker := time.NewTicker(agentTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			// таймаут мог измениться при перезагрузке конфигурации
+			if current := orch.store.Get().AgentTimeout; current != agentTimeout {
+				agentTimeout = current
+				ticker.Reset(agentTimeout / 3)
+			}
+
+			expired, requeued := calcService.ExpireAgents(now, agentTimeout)
+			for _, id := range expired {
+				logger.Printf("Agent %q lost\n", id)
+			}
+			if requeued > 0 {
+				logger.Printf("%d tasks of lost agents requeued\n", requeued)
+			}
+		}
+	}
 }
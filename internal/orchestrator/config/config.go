@@ -1,47 +1,210 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"os"
 	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/agentauth"
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+	"github.com/roadtoseniors/apicalc/pkg/settings"
 )
 
-const errMessageFmt = "The %s environment variable is not set or has an incorrect value."
 type Config struct {
-	Add time.Duration
-	Sub time.Duration
-	Mul time.Duration
-	Div time.Duration
+	Add time.Duration `key:"time_addition" env:"TIME_ADDITION_MS" usage:"duration of +"`
+	Sub time.Duration `key:"time_subtraction" env:"TIME_SUBTRACTION_MS" usage:"duration of -"`
+	Mul time.Duration `key:"time_multiplication" env:"TIME_MULTIPLICATIONS_MS" usage:"duration of *"`
+	Div time.Duration `key:"time_division" env:"TIME_DIVISIONS_MS" usage:"duration of /"`
+
+	// перестраивать цепочки + и * в сбалансированные деревья
+	Rebalance bool `key:"rebalance" env:"REBALANCE"`
+	// точный режим: запрещает оптимизации, меняющие порядок операций над float
+	ExactFloat bool `key:"exact_float" env:"EXACT_FLOAT"`
+
+	// упрощать выражения на оркестраторе
+	Simplify bool `key:"simplify" env:"SIMPLIFY"`
+	// операции не дороже порога над числами вычисляются без агентов, 0 - не вычисляются
+	SimplifyThreshold time.Duration `key:"simplify_cost_threshold" env:"SIMPLIFY_COST_THRESHOLD_MS"`
+
+	// размер и время жизни кэша результатов задач, размер 0 - кэш выключен
+	CacheSize int           `key:"cache_size" env:"CACHE_SIZE" min:"0"`
+	CacheTTL  time.Duration `key:"cache_ttl" env:"CACHE_TTL_MS"`
+
+	// адрес, на котором слушают серверы, пусто - все интерфейсы
+	ListenAddr string `key:"listen_addr" env:"LISTEN_ADDR" flag:"addr" usage:"listen address"`
+	// пользовательский API и маршруты агентов слушают разные порты,
+	// чтобы внутренние маршруты можно было закрыть от пользователей
+	PublicPort   int `key:"public_port" env:"PUBLIC_PORT" flag:"public-port" min:"1" usage:"public API port"`
+	InternalPort int `key:"internal_port" env:"INTERNAL_PORT" flag:"internal-port" min:"1" usage:"agent API port"`
+	// порт gRPC-сервера для агентов
+	GRPCPort int `key:"grpc_port" env:"GRPC_PORT" flag:"grpc-port" min:"1" usage:"agent gRPC port"`
+
+	// таймауты HTTP-серверов, запись должна быть дольше долгого опроса агентов
+	ReadTimeout  time.Duration `key:"http_read_timeout" env:"HTTP_READ_TIMEOUT_MS"`
+	WriteTimeout time.Duration `key:"http_write_timeout" env:"HTTP_WRITE_TIMEOUT_MS"`
+	IdleTimeout  time.Duration `key:"http_idle_timeout" env:"HTTP_IDLE_TIMEOUT_MS"`
+	// сертификат и ключ для TLS, без них серверы работают по HTTP
+	TLSCertFile string `key:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `key:"tls_key_file" env:"TLS_KEY_FILE"`
+
+	// агенты предъявляют общий токен или сертификат, подписанный центром из файла;
+	// если не задано ни то, ни другое, маршруты агентов открыты
+	AgentToken      string `key:"agent_token" env:"AGENT_TOKEN" secret:"true"`
+	TLSClientCAFile string `key:"tls_client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	// токен маршрутов /admin на внутреннем порту; пусто - маршруты закрыты
+	AdminToken string `key:"admin_token" env:"ADMIN_TOKEN" secret:"true"`
+
+	// секрет подписи токенов пользователей; пусто - публичный API открыт,
+	// а выражения общие, как раньше
+	JWTSecret string        `key:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	JWTTTL    time.Duration `key:"jwt_ttl" env:"JWT_TTL_MS" min:"1s"`
+	// без jwt_secret принимать только запросы с API-ключом; ключи тогда
+	// выдаются через /admin/keys. С jwt_secret без ключа нужен токен всегда
+	RequireAuth bool `key:"require_auth" env:"REQUIRE_AUTH"`
+
+	// ограничение частоты запросов по API-ключу, если при выдаче ключа не задано своё;
+	// пользователь может задать своему ключу только меньшие значения
+	APIKeyRate  float64 `key:"api_key_rate" env:"API_KEY_RATE" usage:"default requests per second per API key"`
+	APIKeyBurst int     `key:"api_key_burst" env:"API_KEY_BURST" min:"1"`
+
+	// агент без сигналов дольше этого времени считается потерянным
+	AgentTimeout time.Duration `key:"agent_timeout" env:"AGENT_TIMEOUT_MS" min:"1"`
+
+	// сколько ждать незавершённые выражения при остановке
+	ShutdownTimeout time.Duration `key:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT_MS"`
+	// сколько после этого HTTP-серверы дописывают начатые ответы
+	HTTPShutdownTimeout time.Duration `key:"http_shutdown_timeout" env:"HTTP_SHUTDOWN_TIMEOUT_MS"`
+	// файл для снимка незавершённых выражений, если пусто - только лог
+	SnapshotFile string `key:"snapshot_file" env:"SNAPSHOT_FILE"`
+
+	// сколько операций можно отдать агенту одной задачей, 1 - только по одной;
+	// 0 - операции выражения делятся поровну на воркеров живых агентов,
+	// умеющих вычислять подвыражения, без таких агентов - по одной
+	CoarseMaxOps int `key:"coarse_task_max_ops" env:"COARSE_TASK_MAX_OPS" min:"0"`
+	// предельная суммарная стоимость такой задачи, 0 - без ограничения
+	CoarseBudget time.Duration `key:"coarse_task_budget" env:"COARSE_TASK_BUDGET_MS"`
 }
 
-func NewConfigOrch() (*Config, error){
+// значения по умолчанию
+func defaultConfig() Config {
+	duration := func(symbol string) time.Duration {
+		op, _ := operation.Lookup(symbol)
+		return op.Duration
+	}
+
+	return Config{
+		Add: duration("+"),
+		Sub: duration("-"),
+		Mul: duration("*"),
+		Div: duration("/"),
+
+		CacheTTL: time.Minute,
+
+		PublicPort:   8080,
+		InternalPort: 8081,
+		GRPCPort:     8082,
+
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: time.Minute,
+		IdleTimeout:  2 * time.Minute,
 
-	at, err := time.ParseDuration(os.Getenv("TIME_ADDITION_MS") + "ms")
-	if err != nil || at < 0{
-		return nil, fmt.Errorf(errMessageFmt, "TIME_ADDITION_MS")
+		JWTTTL: 24 * time.Hour,
+
+		APIKeyRate:  10,
+		APIKeyBurst: 20,
+
+		AgentTimeout:        15 * time.Second,
+		ShutdownTimeout:     30 * time.Second,
+		HTTPShutdownTimeout: 5 * time.Second,
+
+		CoarseMaxOps: 0, // по числу воркеров агентов
 	}
+}
 
-	st, err := time.ParseDuration(os.Getenv("TIME_SUBTRACTION_MS") + "ms")
-	if err != nil || st < 0{
-		return nil, fmt.Errorf(errMessageFmt, "TIME_SUBTRACTION_MS")
+// Validate проверяет связанные настройки.
+func (cfg *Config) Validate() error {
+	for key, port := range map[string]int{
+		"public_port":   cfg.PublicPort,
+		"internal_port": cfg.InternalPort,
+		"grpc_port":     cfg.GRPCPort,
+	} {
+		if port > 65535 {
+			return fmt.Errorf("config key %q: port must be at most 65535", key)
+		}
 	}
 
-	mt, err := time.ParseDuration(os.Getenv("TIME_MULTIPLICATIONS_MS") + "ms")
-	if err != nil || mt < 0 {
-		return nil,  fmt.Errorf(errMessageFmt, "TIME_MULTIPLICATIONS_MS")
+	if cfg.PublicPort == cfg.InternalPort || cfg.PublicPort == cfg.GRPCPort || cfg.InternalPort == cfg.GRPCPort {
+		return fmt.Errorf("config keys \"public_port\", \"internal_port\" and \"grpc_port\" must differ")
 	}
 
-	dt, err := time.ParseDuration(os.Getenv("TIME_DIVISIONS_MS") + "ms")
-	if err != nil || dt < 0{
-		return nil, fmt.Errorf(errMessageFmt, "TIME_DIVISIONS_MS")
+	if (len(cfg.TLSCertFile) == 0) != (len(cfg.TLSKeyFile) == 0) {
+		return fmt.Errorf("config keys \"tls_cert_file\" and \"tls_key_file\" must be set together")
 	}
 
-	orchcfg := Config{
-		Add: at,
-		Sub: st,
-		Mul: mt,
-		Div: dt, 
+	if cfg.APIKeyRate <= 0 {
+		return fmt.Errorf("config key \"api_key_rate\" must be positive")
+	}
+
+	if len(cfg.AdminToken) != 0 && cfg.AdminToken == cfg.AgentToken {
+		return fmt.Errorf("config keys \"admin_token\" and \"agent_token\" must differ")
+	}
+
+	if len(cfg.TLSClientCAFile) != 0 && len(cfg.TLSCertFile) == 0 {
+		return fmt.Errorf("config key \"tls_client_ca_file\" requires \"tls_cert_file\"")
+	}
+
+	return nil
+}
+
+// TLSConfig загружает сертификат серверов и центр клиентских сертификатов,
+// nil - серверы работают без TLS.
+func (cfg *Config) TLSConfig() (*tls.Config, error) {
+	if len(cfg.TLSCertFile) == 0 {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if len(cfg.TLSClientCAFile) != 0 {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read TLS_CLIENT_CA_FILE: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE: no certificates found")
+		}
+
+		// пользователи публичного API сертификатов не предъявляют,
+		// агентов без сертификата проверяет агентская авторизация
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// AgentChecker - проверка агентов на внутренних маршрутах и в gRPC
+func (cfg *Config) AgentChecker() agentauth.Checker {
+	return agentauth.Checker{
+		Token:       cfg.AgentToken,
+		ClientCerts: len(cfg.TLSClientCAFile) != 0,
+	}
+}
+
+// NewConfigOrch собирает конфигурацию из файла, окружения и флагов.
+func NewConfigOrch() (*Config, error) {
+	orchcfg := defaultConfig()
+	if err := settings.Load(&orchcfg, "orchestrator", os.Args[1:]); err != nil {
+		return nil, err
 	}
 
 	return &orchcfg, nil
-}
\ No newline at end of file
+}
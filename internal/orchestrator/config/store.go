@@ -0,0 +1,89 @@
+package config
+
+import (
+	"sync"
+
+	"github.com/roadtoseniors/apicalc/pkg/settings"
+)
+
+// Store хранит текущую конфигурацию и позволяет менять её без перезапуска.
+type Store struct {
+	locker    sync.Mutex
+	cfg       Config
+	listeners []func(cfg Config, applied, ignored []string)
+}
+
+func NewStore(cfg Config) *Store {
+	return &Store{
+		cfg: cfg,
+	}
+}
+
+// Get возвращает копию текущей конфигурации.
+func (s *Store) Get() Config {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	return s.cfg
+}
+
+// OnChange вызывает fn с новой конфигурацией и списками изменений после каждого обновления.
+func (s *Store) OnChange(fn func(cfg Config, applied, ignored []string)) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.listeners = append(s.listeners, fn)
+}
+
+// Update меняет копию конфигурации через change и применяет её.
+// Адреса, порты, таймауты серверов, TLS и доступ к API меняются только перезапуском:
+// их изменения не применяются и возвращаются в ignored.
+func (s *Store) Update(change func(*Config) error) (applied, ignored []string, err error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	next := s.cfg
+	if err := change(&next); err != nil {
+		return nil, nil, err
+	}
+
+	merged := next
+	merged.keepStatic(s.cfg)
+
+	if applied, err = settings.Diff(&s.cfg, &merged); err != nil {
+		return nil, nil, err
+	}
+	if ignored, err = settings.Diff(&merged, &next); err != nil {
+		return nil, nil, err
+	}
+
+	s.cfg = merged
+	for _, fn := range s.listeners {
+		fn(merged, applied, ignored)
+	}
+
+	return applied, ignored, nil
+}
+
+// настройки, которые серверы читают только при запуске
+func (cfg *Config) keepStatic(old Config) {
+	cfg.ListenAddr = old.ListenAddr
+	cfg.PublicPort = old.PublicPort
+	cfg.InternalPort = old.InternalPort
+	cfg.GRPCPort = old.GRPCPort
+
+	cfg.ReadTimeout = old.ReadTimeout
+	cfg.WriteTimeout = old.WriteTimeout
+	cfg.IdleTimeout = old.IdleTimeout
+	cfg.TLSCertFile = old.TLSCertFile
+	cfg.TLSKeyFile = old.TLSKeyFile
+	cfg.AgentToken = old.AgentToken
+	cfg.AdminToken = old.AdminToken
+	cfg.TLSClientCAFile = old.TLSClientCAFile
+	cfg.JWTSecret = old.JWTSecret
+	cfg.JWTTTL = old.JWTTTL
+
+	// файл снимка нельзя подменить на лету, иначе PUT /admin/config
+	// позволил бы записать снимок в любой файл
+	cfg.SnapshotFile = old.SnapshotFile
+}
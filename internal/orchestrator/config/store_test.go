@@ -0,0 +1,183 @@
+package config
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/settings"
+)
+
+func testConfig() Config {
+	return Config{
+		Add:          100 * time.Millisecond,
+		CacheSize:    16,
+		PublicPort:   8080,
+		InternalPort: 8081,
+		GRPCPort:     8082,
+		ReadTimeout:  time.Second,
+		AgentToken:   "agent-secret",
+		AdminToken:   "admin-secret",
+		JWTSecret:    "jwt-secret",
+		JWTTTL:       time.Hour,
+		APIKeyRate:   10,
+		APIKeyBurst:  20,
+		SnapshotFile: "snapshot.json",
+	}
+}
+
+// ключи из строк "key: old -> new"
+func keys(changes []string) []string {
+	var keys []string
+	for _, change := range changes {
+		key, _, _ := strings.Cut(change, ":")
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+func TestStoreUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(cfg *Config)
+		wantApplied []string
+		wantIgnored []string
+	}{
+		{
+			name:        "operation time",
+			change:      func(cfg *Config) { cfg.Add = 200 * time.Millisecond },
+			wantApplied: []string{"time_addition"},
+		},
+		{
+			name:        "require auth",
+			change:      func(cfg *Config) { cfg.RequireAuth = true },
+			wantApplied: []string{"require_auth"},
+		},
+		{
+			name: "rate settings",
+			change: func(cfg *Config) {
+				cfg.APIKeyRate = 5
+				cfg.APIKeyBurst = 7
+			},
+			wantApplied: []string{"api_key_rate", "api_key_burst"},
+		},
+		{
+			name: "listeners",
+			change: func(cfg *Config) {
+				cfg.ListenAddr = "0.0.0.0"
+				cfg.PublicPort = 9090
+				cfg.InternalPort = 9091
+				cfg.GRPCPort = 9092
+			},
+			wantIgnored: []string{"listen_addr", "public_port", "internal_port", "grpc_port"},
+		},
+		{
+			name: "server timeouts and TLS",
+			change: func(cfg *Config) {
+				cfg.ReadTimeout = time.Minute
+				cfg.TLSCertFile = "cert.pem"
+				cfg.TLSKeyFile = "key.pem"
+				cfg.TLSClientCAFile = "ca.pem"
+			},
+			wantIgnored: []string{"http_read_timeout", "tls_cert_file", "tls_key_file", "tls_client_ca_file"},
+		},
+		{
+			name: "secrets",
+			change: func(cfg *Config) {
+				cfg.AgentToken = "other"
+				cfg.AdminToken = "other-admin"
+				cfg.JWTSecret = "other-jwt"
+				cfg.JWTTTL = time.Minute
+			},
+			wantIgnored: []string{"agent_token", "admin_token", "jwt_secret", "jwt_ttl"},
+		},
+		{
+			name:        "snapshot file",
+			change:      func(cfg *Config) { cfg.SnapshotFile = "/etc/passwd" },
+			wantIgnored: []string{"snapshot_file"},
+		},
+		{
+			name: "static and dynamic together",
+			change: func(cfg *Config) {
+				cfg.CacheSize = 0
+				cfg.PublicPort = 9090
+				cfg.RequireAuth = true
+				cfg.SnapshotFile = "other.json"
+			},
+			wantApplied: []string{"cache_size", "require_auth"},
+			wantIgnored: []string{"public_port", "snapshot_file"},
+		},
+		{
+			name:   "nothing changed",
+			change: func(cfg *Config) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := testConfig()
+			store := NewStore(base)
+
+			var notified []Config
+			store.OnChange(func(cfg Config, applied, ignored []string) {
+				notified = append(notified, cfg)
+			})
+
+			applied, ignored, err := store.Update(func(cfg *Config) error {
+				tt.change(cfg)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := keys(applied); !slices.Equal(got, tt.wantApplied) {
+				t.Errorf("applied %v, want %v", applied, tt.wantApplied)
+			}
+			if got := keys(ignored); !slices.Equal(got, tt.wantIgnored) {
+				t.Errorf("ignored %v, want %v", ignored, tt.wantIgnored)
+			}
+
+			// от исходной конфигурации отличаются только применённые ключи
+			current := store.Get()
+			changed, err := settings.Diff(&base, &current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keys(changed); !slices.Equal(got, tt.wantApplied) {
+				t.Errorf("store changed %v, want %v", changed, tt.wantApplied)
+			}
+
+			if len(notified) != 1 || notified[0] != current {
+				t.Fatalf("listeners got %+v, want the merged config %+v", notified, current)
+			}
+		})
+	}
+}
+
+// ошибка изменения не трогает конфигурацию и не будит подписчиков
+func TestStoreUpdateError(t *testing.T) {
+	base := testConfig()
+	store := NewStore(base)
+
+	called := false
+	store.OnChange(func(cfg Config, applied, ignored []string) { called = true })
+
+	errInvalid := errors.New("invalid")
+	_, _, err := store.Update(func(cfg *Config) error {
+		cfg.Add = time.Hour
+		return errInvalid
+	})
+	if !errors.Is(err, errInvalid) {
+		t.Fatalf("error %v, want %v", err, errInvalid)
+	}
+	if store.Get() != base {
+		t.Fatal("config changed despite the error")
+	}
+	if called {
+		t.Fatal("listener called despite the error")
+	}
+}
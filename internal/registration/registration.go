@@ -0,0 +1,42 @@
+package registration
+
+import "time"
+
+// Registration - сведения, которые агент сообщает оркестратору при запуске
+type Registration struct {
+	ID       string `json:"id"`
+	Hostname string `json:"hostname"`
+	Workers  int    `json:"workers"`
+
+	// операции, которые умеет выполнять агент, пустой список - любые
+	Operations []string `json:"operations,omitempty"`
+	// относительная стоимость операций на агенте, без веса - 1;
+	// из первых задач очереди агент получает самую дешёвую для него
+	Costs map[string]float64 `json:"costs,omitempty"`
+	// агент умеет вычислять подвыражения целиком
+	Subtrees bool `json:"subtrees,omitempty"`
+	// операции из плагинов агента, неизвестные оркестратору заранее
+	Custom []CustomOperation `json:"custom_operations,omitempty"`
+}
+
+// CustomOperation - функция, которую оркестратор узнаёт от агента
+type CustomOperation struct {
+	Symbol   string        `json:"symbol"`
+	Arity    int           `json:"arity"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Supports сообщает, может ли агент выполнить операцию.
+func (reg Registration) Supports(op string) bool {
+	if len(reg.Operations) == 0 {
+		return true
+	}
+
+	for _, supported := range reg.Operations {
+		if supported == op {
+			return true
+		}
+	}
+
+	return false
+}
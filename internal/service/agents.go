@@ -0,0 +1,386 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+
+	"github.com/roadtoseniors/apicalc/internal/registration"
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// ErrUnknownAgent - агент не зарегистрирован или уже исключён из реестра
+var ErrUnknownAgent = errors.New("unknown agent")
+
+// ErrAnonymousOperations - без проверки агентов любой клиент мог бы
+// добавить оркестратору свои операции
+var ErrAnonymousOperations = errors.New("custom operations require agent authentication")
+
+// Agent - запись реестра агентов
+type Agent struct {
+	registration.Registration
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+	Leased       int       `json:"leased"` // задачи, выданные агенту и ещё не вычисленные
+}
+
+type AgentList struct {
+	Agents []Agent `json:"agents"`
+	// задачи в очереди, которые не может выполнить ни один живой агент
+	Unschedulable []task.Task `json:"unschedulable"`
+}
+
+// задача, выданная агенту
+type lease struct {
+	agentID string
+	task    *task.Task
+}
+
+// регистрируем агента, повторная регистрация обновляет сведения о нём
+func (cs *CalcService) RegisterAgent(reg registration.Registration) error {
+	if len(reg.ID) == 0 {
+		return fmt.Errorf("empty agent ID")
+	}
+	if reg.Workers < 0 {
+		return fmt.Errorf("negative workers count")
+	}
+
+	if len(reg.Custom) != 0 && !cs.agentAuth {
+		return ErrAnonymousOperations
+	}
+
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	if err := cs.learnOperations(reg.Custom); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	agent, found := cs.agents[reg.ID]
+	if !found {
+		agent = &Agent{RegisteredAt: now}
+		cs.agents[reg.ID] = agent
+	}
+	previous := agent.Custom
+	agent.Registration = reg
+	agent.LastSeen = now
+
+	// при повторной регистрации агент мог перестать сообщать о части операций
+	cs.forgetOperations(previous)
+
+	return nil
+}
+
+// добавляем в реестр сервиса операции, о которых сообщил агент;
+// при ошибке реестр не меняется
+func (cs *CalcService) learnOperations(custom []registration.CustomOperation) error {
+	var learned []operation.Operation
+	for _, op := range custom {
+		if op.Duration < 0 {
+			return fmt.Errorf("operation %q: negative duration", op.Symbol)
+		}
+
+		if known, found := cs.ops.Lookup(op.Symbol); found {
+			if !known.Function || known.Arity != op.Arity {
+				return fmt.Errorf("operation %q conflicts with a known operation", op.Symbol)
+			}
+			continue
+		}
+
+		learned = append(learned, operation.Operation{
+			Symbol:   op.Symbol,
+			Arity:    op.Arity,
+			Function: true,
+			Duration: op.Duration,
+		})
+	}
+
+	for i, op := range learned {
+		if err := cs.ops.Register(op); err != nil {
+			for _, registered := range learned[:i] {
+				cs.ops.Remove(registered.Symbol)
+			}
+			return err
+		}
+	}
+	for _, op := range learned {
+		cs.timeTable[op.Symbol] = op.Duration
+	}
+
+	return nil
+}
+
+// убираем из реестра сервиса операции, о которых больше не сообщает
+// ни один живой агент; выражения, уже разобранные с ними, остаются
+func (cs *CalcService) forgetOperations(custom []registration.CustomOperation) {
+	for _, op := range custom {
+		if cs.advertised(op.Symbol) {
+			continue
+		}
+
+		// встроенные операции и операции плагинов оркестратора не удаляются
+		cs.ops.Remove(op.Symbol)
+		if _, found := cs.ops.Lookup(op.Symbol); !found {
+			delete(cs.timeTable, op.Symbol)
+		}
+	}
+}
+
+// сообщает ли о своей операции кто-то из живых агентов
+func (cs *CalcService) advertised(symbol string) bool {
+	for _, agent := range cs.agents {
+		if slices.ContainsFunc(agent.Custom, func(op registration.CustomOperation) bool {
+			return op.Symbol == symbol
+		}) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// отмечаем, что агент жив
+func (cs *CalcService) Heartbeat(id string) error {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	agent, found := cs.agents[id]
+	if !found {
+		return fmt.Errorf("%w: %q", ErrUnknownAgent, id)
+	}
+	agent.LastSeen = time.Now()
+
+	return nil
+}
+
+// исключаем агента из реестра и возвращаем его задачи в очередь
+func (cs *CalcService) DeregisterAgent(id string) (int, error) {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	agent, found := cs.agents[id]
+	if !found {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownAgent, id)
+	}
+	delete(cs.agents, id)
+	cs.forgetOperations(agent.Custom)
+
+	return cs.requeueAgentTasks(id), nil
+}
+
+// исключаем агентов, которые не присылали сигналов дольше timeout,
+// возвращаем идентификаторы исключённых и количество возвращённых задач
+func (cs *CalcService) ExpireAgents(now time.Time, timeout time.Duration) ([]string, int) {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	var expired []string
+	var requeued int
+
+	for id, agent := range cs.agents {
+		if now.Sub(agent.LastSeen) <= timeout {
+			continue
+		}
+
+		delete(cs.agents, id)
+		cs.forgetOperations(agent.Custom)
+		expired = append(expired, id)
+		requeued += cs.requeueAgentTasks(id)
+	}
+
+	return expired, requeued
+}
+
+// список живых агентов
+func (cs *CalcService) ListAgents() AgentList {
+	cs.locker.RLock()
+	defer cs.locker.RUnlock()
+
+	lst := AgentList{Agents: []Agent{}}
+	for _, agent := range cs.agents {
+		lst.Agents = append(lst.Agents, *agent)
+	}
+
+	for _, l := range cs.leases {
+		idx := slices.IndexFunc(lst.Agents, func(a Agent) bool { return a.ID == l.agentID })
+		if idx >= 0 {
+			lst.Agents[idx].Leased++
+		}
+	}
+
+	slices.SortFunc(lst.Agents, func(a, b Agent) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	lst.Unschedulable = []task.Task{}
+	for _, t := range cs.tasks {
+		if !cs.schedulable(t) {
+			lst.Unschedulable = append(lst.Unschedulable, *t)
+		}
+	}
+
+	return lst
+}
+
+// может ли агент выполнить задачу, анонимный агент выполняет любые
+func (cs *CalcService) canRun(agentID string, t *task.Task) bool {
+	agent, found := cs.agents[agentID]
+	if !found {
+		// незарегистрированный агент может не уметь вычислять подвыражения
+		return t.Kind == task.KindOperation
+	}
+
+	return supportsTask(agent.Registration, t)
+}
+
+// есть ли живой агент, умеющий выполнять задачу
+func (cs *CalcService) schedulable(t *task.Task) bool {
+	for _, agent := range cs.agents {
+		if supportsTask(agent.Registration, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// сколько подходящих задач из начала очереди сравниваются по стоимости
+const costWindow = 8
+
+// задача для агента: самая дешёвая для него среди первых costWindow
+// подходящих, при равной стоимости - более ранняя. Задачу, которую обошли
+// costWindow раз, агент берёт сразу, чтобы дорогие операции не ждали
+// бесконечно. -1 - подходящих задач нет.
+func (cs *CalcService) pickTask(agentID string) int {
+	best, bestCost := -1, 0.0
+	var candidates []int
+
+	for idx, t := range cs.tasks {
+		if len(candidates) == costWindow {
+			break
+		}
+		if !cs.canRun(agentID, t) {
+			continue
+		}
+		candidates = append(candidates, idx)
+
+		if cs.skipped[t.ID] >= costWindow {
+			best = idx
+			break
+		}
+		if cost := cs.relativeCost(agentID, t); best < 0 || cost < bestCost {
+			best, bestCost = idx, cost
+		}
+	}
+
+	// более ранние задачи обошли
+	for _, idx := range candidates {
+		if idx < best {
+			cs.skipped[cs.tasks[idx].ID]++
+		}
+	}
+
+	return best
+}
+
+// средний вес операций задачи на агенте, операция без веса стоит 1;
+// без весов у агента все задачи равны и выдаются по очереди
+func (cs *CalcService) relativeCost(agentID string, t *task.Task) float64 {
+	agent, found := cs.agents[agentID]
+	if !found || len(agent.Costs) == 0 {
+		return 1
+	}
+
+	ops := t.Operations()
+	if len(ops) == 0 {
+		return 1
+	}
+
+	total := 0.0
+	for _, op := range ops {
+		weight, found := agent.Costs[op]
+		if !found {
+			weight = 1
+		}
+		total += weight
+	}
+
+	return total / float64(len(ops))
+}
+
+// умеет ли агент выполнять задачу целиком
+func supportsTask(reg registration.Registration, t *task.Task) bool {
+	if t.Kind == task.KindSubtree && !reg.Subtrees {
+		return false
+	}
+
+	for _, op := range t.Operations() {
+		if !reg.Supports(op) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// отмечаем обращение агента за задачами
+func (cs *CalcService) touchAgent(id string) {
+	if agent, found := cs.agents[id]; found {
+		agent.LastSeen = time.Now()
+	}
+}
+
+// ReleaseTasks сразу возвращает в очередь задачи, выданные агенту, но не
+// дошедшие до него или не начатые им. Задачи других агентов и уже вычисленные
+// пропускаются. Возвращает количество возвращённых задач.
+func (cs *CalcService) ReleaseTasks(agentID string, ids []int64) int {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	var tasks []*task.Task
+	for _, id := range ids {
+		l, found := cs.leases[id]
+		if !found || l.agentID != agentID {
+			continue
+		}
+
+		cs.endLease(id)
+		tasks = append(tasks, l.task)
+	}
+
+	cs.pushTasks(tasks...)
+
+	return len(tasks)
+}
+
+// сразу возвращаем в очередь задачи агента, не дожидаясь таймаутов
+func (cs *CalcService) requeueAgentTasks(id string) int {
+	var tasks []*task.Task
+
+	for taskID, l := range cs.leases {
+		if l.agentID != id {
+			continue
+		}
+
+		cs.endLease(taskID)
+		tasks = append(tasks, l.task)
+	}
+
+	cs.pushTasks(tasks...)
+
+	return len(tasks)
+}
+
+// снимаем аренду задачи вместе с её таймаутом
+func (cs *CalcService) endLease(taskID int64) {
+	if timeout, found := cs.timeoutsTable[taskID]; found {
+		timeout.Cancel()
+		delete(cs.timeoutsTable, taskID)
+	}
+	delete(cs.leases, taskID)
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+	"github.com/roadtoseniors/apicalc/internal/registration"
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// агент получает сначала дешёвые для него задачи, но дорогие не ждут вечно
+func TestTakeTaskByCost(t *testing.T) {
+	pluses := func(n int) []string {
+		exprs := make([]string, n)
+		for i := range exprs {
+			exprs[i] = fmt.Sprintf("%d+1", i)
+		}
+		return exprs
+	}
+
+	tests := []struct {
+		name  string
+		costs map[string]float64
+		exprs []string
+		want  string // операции выданных задач по порядку
+	}{
+		{"no costs keep queue order", nil, []string{"2*3", "1+2", "4-1"}, "* + -"},
+		{"cheaper operation first", map[string]float64{"*": 5}, []string{"2*3", "1+2"}, "+ *"},
+		{"equal costs keep queue order", map[string]float64{"*": 2, "+": 2}, []string{"2*3", "1+2"}, "* +"},
+		{"unknown operations cost 1", map[string]float64{"+": 0.5}, []string{"2*3", "4-1", "1+2"}, "+ * -"},
+		{"skipped task is taken after the window", map[string]float64{"*": 5},
+			append([]string{"2*3"}, pluses(costWindow+2)...),
+			strings.Repeat("+ ", costWindow) + "* + +"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := NewCalcService(config.Config{CoarseMaxOps: 1})
+			reg := registration.Registration{ID: "agent", Workers: 1, Costs: tt.costs}
+			if err := cs.RegisterAgent(reg); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, expr := range tt.exprs {
+				if err := cs.AddExpression("", fmt.Sprint(i), expr); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+			for newtask := cs.GetTask("agent"); newtask != nil; newtask = cs.GetTask("agent") {
+				got = append(got, newtask.Operation)
+			}
+
+			if want := strings.Fields(tt.want); !slices.Equal(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			if len(cs.skipped) != 0 {
+				t.Fatalf("skip counters left for taken tasks: %v", cs.skipped)
+			}
+		})
+	}
+}
+
+// задачи, не дошедшие до агента, сразу возвращаются в очередь
+func TestReleaseTasks(t *testing.T) {
+	cs := NewCalcService(config.Config{CoarseMaxOps: 1})
+	for _, id := range []string{"a", "b"} {
+		if err := cs.RegisterAgent(registration.Registration{ID: id, Workers: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, expr := range []string{"1+2", "3+4", "5+6"} {
+		if err := cs.AddExpression("", fmt.Sprint(i), expr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tasks := cs.GetTasks("a", 2)
+	other := cs.GetTask("b")
+	if len(tasks) != 2 || other == nil {
+		t.Fatalf("got %d and %v tasks", len(tasks), other)
+	}
+
+	// чужая задача и неизвестная не возвращаются
+	if n := cs.ReleaseTasks("a", []int64{tasks[0].ID, other.ID, 100}); n != 1 {
+		t.Fatalf("released %d, want 1", n)
+	}
+	if n := cs.ReleaseTasks("a", []int64{tasks[0].ID}); n != 0 {
+		t.Fatalf("released %d twice", n)
+	}
+	if _, leased := cs.timeoutsTable[tasks[0].ID]; leased {
+		t.Fatal("timeout of a released task is still running")
+	}
+
+	if requeued := cs.GetTask("b"); requeued == nil || requeued.ID != tasks[0].ID {
+		t.Fatalf("got %+v, want released task %d", requeued, tasks[0].ID)
+	}
+}
+
+// операции агентов известны только своему сервису и живут, пока о них
+// сообщает хоть один живой агент
+func TestCustomOperations(t *testing.T) {
+	npv := []registration.CustomOperation{{Symbol: "npv_agent", Arity: 3, Duration: time.Second}}
+	cfg := config.Config{CoarseMaxOps: 1, AgentToken: "secret"}
+
+	cs := NewCalcService(cfg)
+	for _, id := range []string{"a", "b"} {
+		if err := cs.RegisterAgent(registration.Registration{ID: id, Workers: 1, Subtrees: true, Custom: npv}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := func(cs *CalcService, id, expr string) string {
+		t.Helper()
+		if err := cs.AddExpression("", id, expr); err != nil {
+			t.Fatal(err)
+		}
+		return cs.exprTable[exprKey("", id)].Status
+	}
+
+	if got := status(cs, "known", "npv_agent(1, 2, 3)"); got != StatusInProcess {
+		t.Fatalf("expression with an agent operation: %s", got)
+	}
+	if operation.IsOperation("npv_agent") {
+		t.Fatal("agent operation leaked into the global registry")
+	}
+	if got := status(NewCalcService(cfg), "other", "npv_agent(1, 2, 3)"); got != StatusError {
+		t.Fatalf("another service parsed an agent operation: %s", got)
+	}
+
+	// функция над задачей разбирается, когда агентов с ней уже нет
+	if got := status(cs, "pending", "npv_agent(1+2, 3, 4)"); got != StatusInProcess {
+		t.Fatalf("expression with an agent operation: %s", got)
+	}
+
+	if _, err := cs.DeregisterAgent("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(cs, "after a", "npv_agent(1, 2, 3)"); got != StatusInProcess {
+		t.Fatalf("operation dropped while agent b advertises it: %s", got)
+	}
+
+	// задачи в очереди, у агентов их нет
+	queued := func(match func(*task.Task) bool) *task.Task {
+		t.Helper()
+		idx := slices.IndexFunc(cs.tasks, match)
+		if idx < 0 {
+			t.Fatal("no such task in the queue")
+		}
+		return cs.tasks[idx]
+	}
+	sum := queued(func(qt *task.Task) bool { return qt.Operation == "+" })
+
+	if expired, _ := cs.ExpireAgents(time.Now().Add(time.Hour), time.Minute); len(expired) != 1 {
+		t.Fatalf("expired %v, want b", expired)
+	}
+	if got := status(cs, "after b", "npv_agent(1, 2, 3)"); got != StatusError {
+		t.Fatalf("operation of gone agents still parses: %s", got)
+	}
+	if _, found := cs.timeTable["npv_agent"]; found {
+		t.Fatal("duration of a dropped operation is still known")
+	}
+
+	if err := cs.PutResult(sum.ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"3.000000", "3.000000", "4.000000", "npv_agent"}
+	queued(func(qt *task.Task) bool { return slices.Equal(qt.RPN, want) })
+}
+
+// без проверки агентов операции от них не принимаются
+func TestAnonymousCustomOperations(t *testing.T) {
+	cs := NewCalcService(config.Config{})
+	reg := registration.Registration{
+		ID:     "agent",
+		Custom: []registration.CustomOperation{{Symbol: "npv_anonymous", Arity: 3}},
+	}
+
+	if err := cs.RegisterAgent(reg); !errors.Is(err, ErrAnonymousOperations) {
+		t.Fatalf("error %v, want %v", err, ErrAnonymousOperations)
+	}
+	if _, found := cs.agents["agent"]; found {
+		t.Fatal("agent registered despite the error")
+	}
+	if cs.ops.IsOperation("npv_anonymous") {
+		t.Fatal("operation of an anonymous agent registered")
+	}
+}
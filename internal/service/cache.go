@@ -0,0 +1,130 @@
+package service
+
+import (
+	"container/list"
+	"fmt"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+)
+
+// CacheStats - статистика кэша результатов задач
+type CacheStats struct {
+	Hits         int64  `json:"hits"`
+	Misses       int64  `json:"misses"`
+	Deduplicated int64  `json:"deduplicated"`
+	Evictions    int64  `json:"evictions"`
+	Size         int    `json:"size"`
+	Capacity     int    `json:"capacity"`
+	TTL          string `json:"ttl"`
+}
+
+type cacheEntry struct {
+	key     string
+	value   float64
+	expires time.Time
+}
+
+// LRU-кэш результатов с ограничением по размеру и времени жизни
+type resultCache struct {
+	order    *list.List // от новых к старым
+	entries  map[string]*list.Element
+	capacity int
+	ttl      time.Duration
+	stats    CacheStats
+}
+
+func newResultCache(capacity int, ttl time.Duration) *resultCache {
+	return &resultCache{
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		capacity: capacity,
+		ttl:      ttl,
+	}
+}
+
+// ключ задачи по операции и операндам
+func taskKey(op, arg1, arg2 string) string {
+	// для коммутативных операций порядок операндов не важен
+	if info, found := operation.Lookup(op); found && info.Commutative && arg1 > arg2 {
+		arg1, arg2 = arg2, arg1
+	}
+
+	return fmt.Sprintf("%s|%s|%s", op, arg1, arg2)
+}
+
+func (c *resultCache) get(key string, now time.Time) (float64, bool) {
+	el, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		return 0, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if now.After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.stats.Misses++
+		return 0, false
+	}
+
+	c.order.MoveToFront(el)
+	c.stats.Hits++
+
+	return entry.value, true
+}
+
+func (c *resultCache) put(key string, value float64, now time.Time) {
+	if c.capacity <= 0 {
+		return
+	}
+
+	if el, found := c.entries[key]; found {
+		entry := el.Value.(*cacheEntry)
+		entry.value = value
+		entry.expires = now.Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+
+	// вытесняем самые старые записи
+	for c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		key:     key,
+		value:   value,
+		expires: now.Add(c.ttl),
+	})
+}
+
+// меняем размер и время жизни, уже сохранённые записи живут по старому сроку
+func (c *resultCache) resize(capacity int, ttl time.Duration) {
+	c.capacity = capacity
+	c.ttl = ttl
+
+	for c.order.Len() > max(capacity, 0) {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// задача не отдана агентам: такая же уже вычисляется
+func (c *resultCache) deduplicated() {
+	c.stats.Deduplicated++
+}
+
+func (c *resultCache) statistics() CacheStats {
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.capacity
+	stats.TTL = c.ttl.String()
+
+	return stats
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+)
+
+func TestResultCache(t *testing.T) {
+	type step struct {
+		op    string // put, get или resize
+		key   string
+		value float64
+		at    time.Duration // время от начала
+		hit   bool          // для get
+		size  int           // для resize - новый размер
+	}
+
+	tests := []struct {
+		name      string
+		capacity  int
+		steps     []step
+		evictions int64
+	}{
+		{"hit and miss", 2, []step{
+			{op: "put", key: "a", value: 1},
+			{op: "get", key: "a", value: 1, hit: true},
+			{op: "get", key: "b"},
+		}, 0},
+		{"least recently used is evicted", 2, []step{
+			{op: "put", key: "a", value: 1},
+			{op: "put", key: "b", value: 2},
+			{op: "get", key: "a", value: 1, hit: true}, // b теперь самый старый
+			{op: "put", key: "c", value: 3},
+			{op: "get", key: "b"},
+			{op: "get", key: "a", value: 1, hit: true},
+			{op: "get", key: "c", value: 3, hit: true},
+		}, 1},
+		{"entry expires after ttl", 2, []step{
+			{op: "put", key: "a", value: 1},
+			{op: "get", key: "a", value: 1, at: time.Minute, hit: true},
+			{op: "get", key: "a", at: time.Minute + time.Second},
+		}, 0},
+		{"put refreshes value and ttl", 2, []step{
+			{op: "put", key: "a", value: 1},
+			{op: "put", key: "a", value: 2, at: 50 * time.Second},
+			{op: "get", key: "a", value: 2, at: 100 * time.Second, hit: true},
+		}, 0},
+		{"zero capacity stores nothing", 0, []step{
+			{op: "put", key: "a", value: 1},
+			{op: "get", key: "a"},
+		}, 0},
+		{"resize evicts the oldest", 3, []step{
+			{op: "put", key: "a", value: 1},
+			{op: "put", key: "b", value: 2},
+			{op: "put", key: "c", value: 3},
+			{op: "resize", size: 1},
+			{op: "get", key: "a"},
+			{op: "get", key: "b"},
+			{op: "get", key: "c", value: 3, hit: true},
+		}, 2},
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newResultCache(tt.capacity, time.Minute)
+			var hits, misses int64
+
+			for i, s := range tt.steps {
+				now := start.Add(s.at)
+				switch s.op {
+				case "put":
+					c.put(s.key, s.value, now)
+				case "resize":
+					c.resize(s.size, time.Minute)
+				case "get":
+					value, hit := c.get(s.key, now)
+					if hit != s.hit || value != s.value {
+						t.Fatalf("step %d: get %q = %v, %t, want %v, %t", i, s.key, value, hit, s.value, s.hit)
+					}
+					if hit {
+						hits++
+					} else {
+						misses++
+					}
+				}
+			}
+
+			stats := c.statistics()
+			if stats.Hits != hits || stats.Misses != misses || stats.Evictions != tt.evictions {
+				t.Fatalf("stats %+v, want %d hits, %d misses, %d evictions", stats, hits, misses, tt.evictions)
+			}
+		})
+	}
+}
+
+func TestTaskKey(t *testing.T) {
+	tests := []struct {
+		a, b [3]string // операция и операнды
+		same bool
+	}{
+		{[3]string{"+", "2", "3"}, [3]string{"+", "3", "2"}, true},
+		{[3]string{"*", "2", "3"}, [3]string{"*", "3", "2"}, true},
+		{[3]string{"-", "2", "3"}, [3]string{"-", "3", "2"}, false},
+		{[3]string{"/", "2", "3"}, [3]string{"/", "3", "2"}, false},
+		{[3]string{"+", "2", "3"}, [3]string{"*", "2", "3"}, false},
+	}
+
+	for _, tt := range tests {
+		a := taskKey(tt.a[0], tt.a[1], tt.a[2])
+		b := taskKey(tt.b[0], tt.b[1], tt.b[2])
+		if (a == b) != tt.same {
+			t.Errorf("%q and %q: same %t, want %t", a, b, a == b, tt.same)
+		}
+	}
+}
+
+// одинаковые задачи вычисляются один раз, результат достаётся всем
+func TestInflightDeduplication(t *testing.T) {
+	tests := []struct {
+		name   string
+		exprs  []string
+		cancel string // отменить это выражение до результата
+		want   map[string]string
+	}{
+		{"same task", []string{"2+3", "2+3"}, "", map[string]string{"0": "5", "1": "5"}},
+		{"commutative operands", []string{"2+3", "3+2"}, "", map[string]string{"0": "5", "1": "5"}},
+		{"leader cancelled", []string{"2+3", "3+2"}, "0", map[string]string{"0": "", "1": "5"}},
+		{"follower cancelled", []string{"2+3", "3+2"}, "1", map[string]string{"0": "5", "1": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := NewCalcService(config.Config{CoarseMaxOps: 1, CacheSize: 16, CacheTTL: time.Minute})
+			for i, expr := range tt.exprs {
+				if err := cs.AddExpression("", string(rune('0'+i)), expr); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tasks := cs.GetTasks("", 10)
+			if len(tasks) != 1 {
+				t.Fatalf("got %d tasks, want 1", len(tasks))
+			}
+			if stats := cs.CacheStats(); stats.Deduplicated != int64(len(tt.exprs)-1) {
+				t.Fatalf("deduplicated %d", stats.Deduplicated)
+			}
+
+			if len(tt.cancel) != 0 {
+				if _, err := cs.CancelExpression("", tt.cancel); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := cs.PutResult(tasks[0].ID, 5); err != nil {
+				t.Fatal(err)
+			}
+
+			for id, want := range tt.want {
+				unit, err := cs.FindById("", id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if unit.Expr.Result != want {
+					t.Errorf("expression %s: result %q, want %q", id, unit.Expr.Result, want)
+				}
+			}
+
+			// следующее такое же выражение берёт результат из кэша
+			if err := cs.AddExpression("", "cached", "3+2"); err != nil {
+				t.Fatal(err)
+			}
+			if unit, _ := cs.FindById("", "cached"); unit.Expr.Status != StatusDone || unit.Expr.Result != "5" {
+				t.Fatalf("cached expression %+v", unit.Expr)
+			}
+			if len(cs.inflight) != 0 || len(cs.followers) != 0 || len(cs.taskKeys) != 0 {
+				t.Fatalf("bookkeeping left: inflight %v, followers %v, keys %v", cs.inflight, cs.followers, cs.taskKeys)
+			}
+		})
+	}
+}
+
+// без cache_size одинаковые задачи всё равно не дублируются, но результаты не сохраняются
+func TestCacheDisabled(t *testing.T) {
+	cs := NewCalcService(config.Config{CoarseMaxOps: 1})
+	for _, id := range []string{"a", "b"} {
+		if err := cs.AddExpression("", id, "2+3"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tasks := cs.GetTasks("", 10)
+	if len(tasks) != 1 {
+		t.Fatalf("got %d tasks, want 1", len(tasks))
+	}
+	if err := cs.PutResult(tasks[0].ID, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cs.AddExpression("", "c", "2+3"); err != nil {
+		t.Fatal(err)
+	}
+	if tasks := cs.GetTasks("", 10); len(tasks) != 1 {
+		t.Fatalf("got %d tasks, want 1 for the uncached expression", len(tasks))
+	}
+
+	stats := cs.CacheStats()
+	if stats.Deduplicated != 1 || stats.Hits != 0 || stats.Size != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
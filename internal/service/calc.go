@@ -1,11 +1,15 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"slices"
 	"sync"
 	"time"
 
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+	"github.com/roadtoseniors/apicalc/pkg/pubsub"
 	"github.com/roadtoseniors/apicalc/pkg/timeout"
 
 	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
@@ -14,30 +18,108 @@ import (
 
 type CalcService struct {
 	locker        sync.RWMutex
-	exprTable     map[string]*Expression
+	exprTable     map[exprID]*Expression
 	taskID        int64
 	tasks         []*task.Task
 	taskTable     map[int64]ExprElement
 	timeTable     map[string]time.Duration
 	timeoutsTable map[int64]*timeout.Timeout
+	exprOptions   ExpressionOptions
+	ops           *operation.Registry // общий реестр и операции живых агентов
+	coarse        CoarseOptions
+
+	cache     *resultCache
+	inflight  map[string]int64  // ключ задачи -> задача, отданная агентам
+	followers map[int64][]int64 // задача -> одинаковые задачи, ждущие её результата
+	taskKeys  map[int64]string
+
+	taskReady chan struct{} // закрывается, когда в очереди появляются задачи
+
+	agents  map[string]*Agent
+	leases  map[int64]lease
+	skipped map[int64]int // сколько раз задачу в очереди обошли более дешёвой
+	// операции можно узнавать от агентов, только если агенты проверяются
+	agentAuth bool
+
+	draining bool
+
+	users   map[string]*user
+	apiKeys map[string]*apiKey // хэш ключа -> ключ
+
+	events *pubsub.Hub[Event]
 }
 
+// ErrDuplicateID - выражение с таким ID уже есть
+var ErrDuplicateID = errors.New("not a unique ID")
+
 func NewCalcService(cfg config.Config) *CalcService {
 	cs := CalcService{
-		exprTable:     make(map[string]*Expression),
+		exprTable:     make(map[exprID]*Expression),
 		taskTable:     make(map[int64]ExprElement),
-		timeTable:     make(map[string]time.Duration),
 		timeoutsTable: make(map[int64]*timeout.Timeout),
+		ops:           operation.NewRegistry(operation.Global()),
+		cache:         newResultCache(cfg.CacheSize, cfg.CacheTTL),
+		inflight:      make(map[string]int64),
+		followers:     make(map[int64][]int64),
+		taskKeys:      make(map[int64]string),
+		taskReady:     make(chan struct{}),
+		agents:        make(map[string]*Agent),
+		leases:        make(map[int64]lease),
+		agentAuth:     cfg.AgentChecker().Enabled(),
+		skipped:       make(map[int64]int),
+		users:         make(map[string]*user),
+		apiKeys:       make(map[string]*apiKey),
+		events:        pubsub.NewHub[Event](eventBuffer),
 	}
-	cs.timeTable["+"] = cfg.Add
-	cs.timeTable["-"] = cfg.Sub
-	cs.timeTable["*"] = cfg.Mul
-	cs.timeTable["/"] = cfg.Div
+	cs.configure(cfg)
 
 	return &cs
 }
 
-func (cs *CalcService) AddExpression(id, expr string) error {
+// Reconfigure применяет новые времена операций и ограничения.
+// Выражения и задачи, созданные раньше, остаются как есть,
+// новые значения действуют для задач, извлечённых после вызова.
+func (cs *CalcService) Reconfigure(cfg config.Config) {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	cs.configure(cfg)
+	cs.cache.resize(cfg.CacheSize, cfg.CacheTTL)
+}
+
+// настройки, которые можно менять на ходу
+func (cs *CalcService) configure(cfg config.Config) {
+	// время из конфигурации важнее значений по умолчанию,
+	timeTable := make(map[string]time.Duration)
+	for _, op := range cs.ops.All() {
+		timeTable[op.Symbol] = op.Duration
+	}
+	timeTable["+"] = cfg.Add
+	timeTable["-"] = cfg.Sub
+	timeTable["*"] = cfg.Mul
+	timeTable["/"] = cfg.Div
+	cs.timeTable = timeTable
+
+	cs.exprOptions = ExpressionOptions{
+		// перестановка слагаемых меняет результат в точном режиме
+		Rebalance: cfg.Rebalance && !cfg.ExactFloat,
+		Simplify: SimplifyOptions{
+			Enabled:       cfg.Simplify,
+			FoldThreshold: cfg.SimplifyThreshold,
+			Costs:         timeTable,
+			ExactFloat:    cfg.ExactFloat,
+		},
+		Ops: cs.ops,
+	}
+
+	cs.coarse = CoarseOptions{
+		MaxOps: cfg.CoarseMaxOps,
+		Budget: cfg.CoarseBudget,
+	}
+}
+
+// добавляем выражение пользователя owner, пустой owner - выражение без владельца
+func (cs *CalcService) AddExpression(owner, id, expr string) error {
 	if len(id) == 0 {
 		return fmt.Errorf("empty ID")
 	}
@@ -48,27 +130,51 @@ func (cs *CalcService) AddExpression(id, expr string) error {
 	cs.locker.Lock()
 	defer cs.locker.Unlock()
 
-	if _, found := cs.exprTable[id]; found {
-		return fmt.Errorf("not a unique ID: %q", id)
+	if cs.draining {
+		return ErrDraining
+	}
+
+	key := exprKey(owner, id)
+	if _, found := cs.exprTable[key]; found {
+		return fmt.Errorf("%w: %q", ErrDuplicateID, id)
 	}
 
-	expression, err := NewExpression(id, expr)
-	cs.exprTable[id] = expression
+	expression, err := NewExpression(id, expr, cs.exprOptions)
+	if expression == nil {
+		return err
+	}
+	expression.Owner = owner
+	cs.exprTable[key] = expression
 	//извлекаем задачи если выражение в процессе вычисления
 	if err == nil && expression.Status == StatusInProcess {
 		cs.extractTasksFromExpression(expression)
 	}
 
+	cs.publish(EventCreated, expression, nil)
+	switch {
+	case err != nil:
+		cs.events.Publish(Event{
+			Type:       EventError,
+			Expression: snapshotExpression(expression),
+			Error:      err.Error(),
+		})
+	case expression.Status == StatusDone:
+		cs.publish(EventDone, expression, nil)
+	}
+
 	return nil
 }
 
-// возвращаем список всех выражений
-func (cs *CalcService) ListAll() ExpressionList {
+// возвращаем список всех выражений пользователя
+func (cs *CalcService) ListAll(owner string) ExpressionList {
 	cs.locker.RLock()
 	defer cs.locker.RUnlock()
 
-	lst := ExpressionList{}
+	lst := ExpressionList{Exprs: []Expression{}}
 	for _, expr := range cs.exprTable {
+		if expr.Owner != owner {
+			continue
+		}
 		lst.Exprs = append(lst.Exprs, *expr)
 	}
 
@@ -86,12 +192,12 @@ func (cs *CalcService) ListAll() ExpressionList {
 }
 
 // возвращаю выражение по айди
-func (cs *CalcService) FindById(id string) (*ExpressionUnit, error) {
+func (cs *CalcService) FindById(owner, id string) (*ExpressionUnit, error) {
 	cs.locker.RLock()
 	defer cs.locker.RUnlock()
 
-	// ищу в таблице
-	expr, found := cs.exprTable[id]
+	// ищу в таблице, чужие выражения не видны
+	expr, found := cs.exprTable[exprKey(owner, id)]
 	if !found {
 		return nil, fmt.Errorf("id %q not found", id)
 	}
@@ -99,36 +205,125 @@ func (cs *CalcService) FindById(id string) (*ExpressionUnit, error) {
 	return &ExpressionUnit{Expr: *expr}, nil
 }
 
-// возврат для выполнения задачи
-func (cs *CalcService) GetTask() *task.Task {
+// возврат для выполнения задачи, agentID может быть пустым
+func (cs *CalcService) GetTask(agentID string) *task.Task {
 	cs.locker.Lock()
 	defer cs.locker.Unlock()
 
-	if len(cs.tasks) == 0 {
+	cs.touchAgent(agentID)
+
+	return cs.takeTask(agentID)
+}
+
+// возврат до limit задач за раз
+func (cs *CalcService) GetTasks(agentID string, limit int) []*task.Task {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	cs.touchAgent(agentID)
+
+	return cs.takeTasks(agentID, limit)
+}
+
+// ждём появления задачи, пока не истечёт контекст
+func (cs *CalcService) WaitTask(ctx context.Context, agentID string) *task.Task {
+	tasks := cs.WaitTasks(ctx, agentID, 1)
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	return tasks[0]
+}
+
+// ждём появления задач и забираем до limit штук
+func (cs *CalcService) WaitTasks(ctx context.Context, agentID string, limit int) []*task.Task {
+	for {
+		cs.locker.Lock()
+		cs.touchAgent(agentID)
+		tasks := cs.takeTasks(agentID, limit)
+		ready := cs.taskReady
+		cs.locker.Unlock()
+
+		if len(tasks) != 0 {
+			return tasks
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// ставим задачи в очередь и будим ожидающих
+func (cs *CalcService) pushTasks(tasks ...*task.Task) {
+	if len(tasks) == 0 {
+		return
+	}
+
+	cs.tasks = append(cs.tasks, tasks...)
+
+	close(cs.taskReady)
+	cs.taskReady = make(chan struct{})
+}
+
+// забираем из очереди до limit задач
+func (cs *CalcService) takeTasks(agentID string, limit int) []*task.Task {
+	var tasks []*task.Task
+
+	for len(tasks) < limit {
+		newtask := cs.takeTask(agentID)
+		if newtask == nil {
+			break
+		}
+		tasks = append(tasks, newtask)
+	}
+
+	return tasks
+}
+
+// забираем задачу из очереди и запускаем её таймаут
+func (cs *CalcService) takeTask(agentID string) *task.Task {
+	// задача, которую умеет выполнять агент, с учётом стоимости операций на нём
+	idx := cs.pickTask(agentID)
+	if idx < 0 {
 		return nil
 	}
 
-	newtask := cs.tasks[0]
-	cs.tasks = cs.tasks[1:]
+	newtask := cs.tasks[idx]
+	cs.tasks = slices.Delete(cs.tasks, idx, idx+1)
+	delete(cs.skipped, newtask.ID)
 
-	cs.timeoutsTable[newtask.ID] = timeout.NewTimeout(
+	timeout := timeout.NewTimeout(
 		5*time.Second + newtask.OperationTime,
 	)
+	cs.timeoutsTable[newtask.ID] = timeout
+	cs.leases[newtask.ID] = lease{agentID: agentID, task: newtask}
+
+	if expr, found := cs.exprTable[cs.taskTable[newtask.ID].Key]; found {
+		cs.publish(EventDispatched, expr, &TaskEvent{ID: newtask.ID, Agent: agentID})
+	}
 
 	// горутина обрабатывает таймаут
 	go func(task task.Task) {
-		cs.locker.Lock()
-		timeout, found := cs.timeoutsTable[task.ID]
-		cs.locker.Unlock()
-		if !found {
-			return
-		}
-
 		select {
 		case <-timeout.Timer.C:
 			cs.locker.Lock()
-			cs.tasks = append(cs.tasks, &task)
-			cs.locker.Unlock()
+			defer cs.locker.Unlock()
+
+			// пока ждали блокировку, могли прийти результат, уйти агент
+			// или задачу уже выдали снова с новым таймаутом
+			if cs.timeoutsTable[task.ID] != timeout {
+				return
+			}
+			delete(cs.timeoutsTable, task.ID)
+
+			if _, leased := cs.leases[task.ID]; !leased {
+				return
+			}
+			delete(cs.leases, task.ID)
+			cs.pushTasks(&task)
 		case <-timeout.Ctx.Done():
 			return
 		}
@@ -145,81 +340,88 @@ func (cs *CalcService) PutResult(id int64, value float64) error {
 	timeout, found := cs.timeoutsTable[id]
 	if found {
 		timeout.Cancel()
+		delete(cs.timeoutsTable, id)
 	}
+	delete(cs.leases, id)
 
 	_, found = cs.taskTable[id]
-	if !found {
+	// выражение задачи отменено, но результат ещё ждут дубликаты
+	if !found && len(cs.followers[id]) == 0 {
 		return fmt.Errorf("Task id %d not found", id)
 	}
 
+	key := cs.taskKeys[id]
+	cs.cache.put(key, value, time.Now())
+	if cs.inflight[key] == id {
+		delete(cs.inflight, key)
+	}
+
+	// результат нужен и всем задачам-дубликатам
+	followers := cs.followers[id]
+	delete(cs.followers, id)
+
+	var err error
+	if found {
+		err = cs.applyResult(id, value)
+	} else {
+		delete(cs.taskKeys, id)
+	}
+	for _, followerID := range followers {
+		cs.applyResult(followerID, value)
+	}
+
+	return err
+}
+
+// подставляю результат задачи в выражение
+func (cs *CalcService) applyResult(id int64, value float64) error {
 	el := cs.taskTable[id].Ptr
-	exprID := cs.taskTable[id].ID
+	exprKey := cs.taskTable[id].Key
 	delete(cs.taskTable, id)
+	delete(cs.taskKeys, id)
 
-	expr, found := cs.exprTable[exprID]
+	expr, found := cs.exprTable[exprKey]
 	if !found {
 		return fmt.Errorf("Expression for task %d not found", id)
 	}
 
-	if expr.Len() == 1 {
-		expr.Result = fmt.Sprintf("%g", value)
-		expr.Status = StatusDone
-		expr.Remove(el)
-	} else {
-		numToken := NumToken{value}
-		expr.InsertBefore(numToken, el)
-		expr.Remove(el)
-		cs.extractTasksFromExpression(expr)
+	numToken := NumToken{value}
+	expr.InsertBefore(numToken, el)
+	expr.Remove(el)
+	cs.extractTasksFromExpression(expr)
+
+	cs.publish(EventPartial, expr, &TaskEvent{ID: id, Value: fmt.Sprintf("%g", value)})
+	if expr.Status == StatusDone {
+		cs.publish(EventDone, expr, nil)
 	}
 
 	return nil
 }
 
-// извлекаю все задачи для выполнения
-func (cs *CalcService) extractTasksFromExpression(expr *Expression) int {
-	var taskCount int
-	el := expr.Front()
-
-	for el != nil {
-		el1 := el
-		if el1.Value.(Token).Type() != TokenTypeNumber {
-			el = el.Next()
-			continue
-		}
+// статистика кэша результатов
+func (cs *CalcService) CacheStats() CacheStats {
+	cs.locker.RLock()
+	defer cs.locker.RUnlock()
 
-		el2 := el1.Next()
-		if el2 == nil || el2.Value.(Token).Type() != TokenTypeNumber {
-			el = el.Next()
-			continue
-		}
+	return cs.cache.statistics()
+}
 
-		op := el2.Next()
-		if op == nil || op.Value.(Token).Type() != TokenTypeOperation {
-			el = el.Next()
-			continue
+// извлекаю все задачи для выполнения
+func (cs *CalcService) extractTasksFromExpression(expr *Expression) int {
+	var newTasks []*task.Task
+	// результат из кэша может образовать новую задачу с соседними токенами
+	for cs.extractPass(expr, &newTasks) {
+	}
+	cs.pushTasks(newTasks...)
+
+	// выражение полностью вычислено
+	if front := expr.Front(); front != nil && expr.Len() == 1 {
+		if num, ok := front.Value.(NumToken); ok {
+			expr.Result = fmt.Sprintf("%g", num.Value)
+			expr.Status = StatusDone
+			expr.Remove(front)
 		}
-
-		// создаём новую задачу
-		task := new(task.Task)
-		task.ID = cs.taskID
-		cs.taskID++
-		taskToken := TaskToken{ID: task.ID}
-		taskElement := expr.InsertBefore(&taskToken, el)
-		cs.taskTable[task.ID] = ExprElement{expr.ID, taskElement}
-
-		task.Arg1 = fmt.Sprintf("%f", el1.Value.(NumToken).Value)
-		task.Arg2 = fmt.Sprintf("%f", el2.Value.(NumToken).Value)
-		task.Operation = op.Value.(OpToken).Value
-		task.OperationTime = cs.timeTable[task.Operation]
-
-		taskCount++
-		cs.tasks = append(cs.tasks, task)
-		el = op.Next()
-
-		expr.Remove(el1)
-		expr.Remove(el2)
-		expr.Remove(op)
 	}
 
-	return taskCount
+	return len(newTasks)
 }
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+)
+
+// выражения разных владельцев не путаются, даже если ID содержит "/"
+func TestExpressionKeysDoNotCollide(t *testing.T) {
+	cs := NewCalcService(config.Config{CoarseMaxOps: 1})
+
+	tests := []struct {
+		owner, id, expr string
+	}{
+		{"alice", "x/y", "1"},
+		{"alice/x", "y", "2"},
+		{"", "alice/x/y", "3"},
+		{"alice", "y", "4"},
+	}
+
+	for _, tt := range tests {
+		if err := cs.AddExpression(tt.owner, tt.id, tt.expr); err != nil {
+			t.Fatalf("add %q of %q: %v", tt.id, tt.owner, err)
+		}
+	}
+
+	for _, tt := range tests {
+		unit, err := cs.FindById(tt.owner, tt.id)
+		if err != nil {
+			t.Fatalf("find %q of %q: %v", tt.id, tt.owner, err)
+		}
+		if unit.Expr.Result != tt.expr {
+			t.Errorf("%q of %q: result %q, want %q", tt.id, tt.owner, unit.Expr.Result, tt.expr)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// ErrFinished - выражение уже вычислено, не разобрано или отменено
+var ErrFinished = errors.New("expression is already finished")
+
+// CancelExpression останавливает вычисление выражения. Его задачи убираются
+// из очереди, результаты задач, уже отданных агентам, будут отклонены.
+func (cs *CalcService) CancelExpression(owner, id string) (*ExpressionUnit, error) {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	key := exprKey(owner, id)
+	expr, found := cs.exprTable[key]
+	if !found {
+		return nil, fmt.Errorf("id %q not found", id)
+	}
+	if expr.Status != StatusInProcess {
+		return nil, fmt.Errorf("%w: %q is %s", ErrFinished, id, expr.Status)
+	}
+
+	for taskID, el := range cs.taskTable {
+		if el.Key == key {
+			cs.dropTask(taskID)
+		}
+	}
+
+	expr.Init()
+	expr.Status = StatusCancelled
+	cs.publish(EventCancelled, expr, nil)
+
+	return &ExpressionUnit{Expr: *expr}, nil
+}
+
+// убираем задачу отменённого выражения
+func (cs *CalcService) dropTask(id int64) {
+	delete(cs.taskTable, id)
+
+	// дубликат просто перестаёт ждать результата
+	for leader, followers := range cs.followers {
+		if idx := slices.Index(followers, id); idx >= 0 {
+			cs.followers[leader] = slices.Delete(followers, idx, idx+1)
+			delete(cs.taskKeys, id)
+
+			// выражение ведущей задачи тоже отменено, она больше никому не нужна
+			if _, found := cs.taskTable[leader]; !found && len(cs.followers[leader]) == 0 {
+				delete(cs.followers, leader)
+				cs.dropTask(leader)
+			}
+			return
+		}
+	}
+
+	// результат ждут дубликаты из других выражений, задача остаётся
+	if len(cs.followers[id]) != 0 {
+		return
+	}
+
+	key := cs.taskKeys[id]
+	delete(cs.taskKeys, id)
+	if cs.inflight[key] == id {
+		delete(cs.inflight, key)
+	}
+
+	if timeout, found := cs.timeoutsTable[id]; found {
+		timeout.Cancel()
+		delete(cs.timeoutsTable, id)
+	}
+	delete(cs.leases, id)
+	delete(cs.skipped, id)
+
+	cs.tasks = slices.DeleteFunc(cs.tasks, func(t *task.Task) bool {
+		return t.ID == id
+	})
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/roadtoseniors/apicalc/pkg/pubsub"
+)
+
+// типы событий выражения
+const (
+	EventCreated    = "created"    // выражение принято
+	EventDispatched = "dispatched" // задача выражения отдана агенту
+	EventPartial    = "partial"    // получен результат задачи
+	EventDone       = "done"       // выражение вычислено
+	EventError      = "error"      // выражение не разобрано
+	EventCancelled  = "cancelled"  // вычисление отменено
+	EventSnapshot   = "snapshot"   // состояние на момент подписки
+)
+
+// сколько событий ждут чтения у подписчика, пока его не отключат
+const eventBuffer = 256
+
+// Event - изменение выражения и его состояние после изменения
+type Event struct {
+	Type       string     `json:"type"`
+	Expression Expression `json:"expression"`
+	Task       *TaskEvent `json:"task,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// TaskEvent - задача, к которой относится событие
+type TaskEvent struct {
+	ID    int64  `json:"id"`
+	Agent string `json:"agent,omitempty"` // кому отдана задача
+	Value string `json:"value,omitempty"` // результат задачи
+}
+
+// Subscribe подписывает на события выражений владельца owner,
+// пустой id - на все его выражения. Для одного выражения возвращает
+// и его состояние на момент подписки: события после него не теряются.
+func (cs *CalcService) Subscribe(owner, id string) (*pubsub.Subscription[Event], *Expression, error) {
+	// события публикуются под блокировкой записи
+	cs.locker.RLock()
+	defer cs.locker.RUnlock()
+
+	if len(id) == 0 {
+		sub := cs.events.Subscribe(func(e Event) bool {
+			return e.Expression.Owner == owner
+		})
+		return sub, nil, nil
+	}
+
+	expr, found := cs.exprTable[exprKey(owner, id)]
+	if !found {
+		return nil, nil, fmt.Errorf("id %q not found", id)
+	}
+
+	sub := cs.events.Subscribe(func(e Event) bool {
+		return e.Expression.Owner == owner && e.Expression.ID == id
+	})
+	current := snapshotExpression(expr)
+
+	return sub, &current, nil
+}
+
+// рассылаем событие о выражении, вызывается под блокировкой записи
+func (cs *CalcService) publish(typ string, expr *Expression, taskEvent *TaskEvent) {
+	cs.events.Publish(Event{
+		Type:       typ,
+		Expression: snapshotExpression(expr),
+		Task:       taskEvent,
+	})
+}
+
+// копия выражения без списка токенов, который меняется под блокировкой
+func snapshotExpression(expr *Expression) Expression {
+	snapshot := *expr
+	snapshot.List = nil
+
+	return snapshot
+}
@@ -2,16 +2,20 @@ package service
 
 import (
 	"container/list"
+	"fmt"
 	"strconv"
-	"strings"
 
+	"github.com/roadtoseniors/apicalc/pkg/operation"
 	"github.com/roadtoseniors/apicalc/pkg/rpn"
+
+	"github.com/roadtoseniors/apicalc/internal/task"
 )
 
 const (
 	StatusError     = "Error"
 	StatusDone      = "Done"
 	StatusInProcess = "In process"
+	StatusCancelled = "Cancelled"
 )
 
 const (
@@ -34,6 +38,9 @@ func (num NumToken) Type() int {
 
 type OpToken struct {
 	Value string
+	// количество операндов запоминается при разборе: операции агентов
+	// могут пропасть из реестра раньше, чем вычислится выражение
+	Arity int
 }
 
 func (num OpToken) Type() int {
@@ -41,7 +48,8 @@ func (num OpToken) Type() int {
 }
 
 type TaskToken struct {
-	ID int64
+	ID   int64
+	Task *task.Task // задача, которой заменено поддерево
 }
 
 func (num TaskToken) Type() int {
@@ -54,6 +62,25 @@ type Expression struct {
 	Status     string `json:"status"`
 	Result     string `json:"result"`
 	Source     string `json:"source"` // исходник
+	Owner      string `json:"owner,omitempty"`
+	// глубина дерева выражения после оптимизации и до неё
+	Depth         int `json:"depth"`
+	OriginalDepth int `json:"original_depth,omitempty"`
+	// правила упрощения, применённые на оркестраторе
+	Rewrites []string `json:"rewrites,omitempty"`
+}
+
+// ExpressionOptions - необязательные проходы над выражением
+type ExpressionOptions struct {
+	Rebalance bool // балансировка цепочек ассоциативных операторов
+	Simplify  SimplifyOptions
+	// операции, из которых состоит выражение, nil - общий реестр
+	Ops *operation.Registry
+}
+
+// ключ выражения в таблице
+func (expr *Expression) key() exprID {
+	return exprKey(expr.Owner, expr.ID)
 }
 
 type ExpressionUnit struct {
@@ -64,9 +91,24 @@ type ExpressionList struct {
 	Exprs []Expression `json:"expressions"`
 }
 
-func NewExpression(id, expr string) (*Expression, error) {
+func NewExpression(id, expr string, opts ExpressionOptions) (*Expression, error) {
+	ops := opts.Ops
+	if ops == nil {
+		ops = operation.Global()
+	}
+
 	// преобразуем выражение в обратную польскую запись
-	rpn, err := rpn.NewRPN(expr)
+	rpnarr, err := rpn.NewRPNWith(expr, ops)
+	var depth, originalDepth int
+	if err == nil {
+		originalDepth, err = rpn.DepthWith(rpnarr, ops)
+	}
+	if err == nil && opts.Rebalance {
+		rpnarr, err = rpn.RebalanceWith(rpnarr, ops)
+	}
+	if err == nil {
+		depth, err = rpn.DepthWith(rpnarr, ops)
+	}
 	if err != nil {
 		// если произошла ошибка
 		expression := Expression{
@@ -80,12 +122,12 @@ func NewExpression(id, expr string) (*Expression, error) {
 	}
 
 	// Если выражение состоит из одного числа, создаём выражение со статусом "Done".
-	if len(rpn) == 1 {
+	if len(rpnarr) == 1 {
 		expression := Expression{
 			List:   list.New(),
 			ID:     id,
 			Status: StatusDone,
-			Result: rpn[0],
+			Result: rpnarr[0],
 			Source: expr,
 		}
 		return &expression, nil
@@ -98,13 +140,19 @@ func NewExpression(id, expr string) (*Expression, error) {
 		Status: StatusInProcess,
 		Result: "",
 		Source: expr,
+		Depth:  depth,
+	}
+
+	// сообщаем, насколько балансировка уменьшила глубину
+	if opts.Rebalance {
+		expression.OriginalDepth = originalDepth
 	}
 
 	// Преобразуем RPN в список токенов.
-	for _, val := range rpn {
-		if strings.Contains("-+*/", val) {
+	for _, val := range rpnarr {
+		if info, found := ops.Lookup(val); found {
 			// Если это операция, добавляем OpToken.
-			expression.PushBack(OpToken{val})
+			expression.PushBack(OpToken{Value: val, Arity: info.Arity})
 		} else {
 			// Если это число, преобразуем его в float64 и добавляем NumToken.
 			num, err := strconv.ParseFloat(val, 10)
@@ -115,10 +163,21 @@ func NewExpression(id, expr string) (*Expression, error) {
 		}
 	}
 
+	if opts.Simplify.Enabled {
+		expression.Rewrites = simplify(&expression, opts.Simplify)
+
+		// выражение полностью вычислено без агентов
+		if num, ok := expression.Front().Value.(NumToken); ok && expression.Len() == 1 {
+			expression.Init()
+			expression.Status = StatusDone
+			expression.Result = fmt.Sprintf("%g", num.Value)
+		}
+	}
+
 	return &expression, nil
 }
 
 type ExprElement struct {
-	ID  string
+	Key exprID        // ключ выражения в таблице
 	Ptr *list.Element // Указатель на элемент списка
 }
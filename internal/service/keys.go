@@ -0,0 +1,161 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/ratelimit"
+)
+
+// права API-ключей
+const (
+	ScopeSubmit = "submit" // отправка выражений
+	ScopeRead   = "read"   // чтение выражений
+	ScopeAdmin  = "admin"  // управление ключами
+)
+
+var scopes = []string{ScopeSubmit, ScopeRead, ScopeAdmin}
+
+var (
+	// ErrUnknownAPIKey - ключ не выдавался или отозван
+	ErrUnknownAPIKey = errors.New("unknown API key")
+	// ErrUnknownUser - нет пользователя с таким логином
+	ErrUnknownUser = errors.New("unknown user")
+)
+
+// APIKey - ключ для обращений сервисов к публичному API
+type APIKey struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner,omitempty"` // выражения, отправленные с ключом, принадлежат владельцу
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	Rate      float64   `json:"rate"`  // запросов в секунду
+	Burst     int       `json:"burst"` // запросов подряд сверх Rate
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HasScope - есть ли у ключа право scope
+func (key APIKey) HasScope(scope string) bool {
+	return slices.Contains(key.Scopes, scope)
+}
+
+// выданный ключ, сам ключ не хранится, только его хэш
+type apiKey struct {
+	APIKey
+	bucket *ratelimit.Bucket
+}
+
+// хэш ключа, по которому он ищется
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// случайная строка из n байт в hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// выдаём ключ, возвращаем его описание и сам ключ, который больше нигде не виден
+func (cs *CalcService) CreateAPIKey(key APIKey) (APIKey, string, error) {
+	if len(key.Scopes) == 0 {
+		return APIKey{}, "", fmt.Errorf("at least one scope is required: %s", strings.Join(scopes, ", "))
+	}
+	for _, scope := range key.Scopes {
+		if !slices.Contains(scopes, scope) {
+			return APIKey{}, "", fmt.Errorf("unknown scope %q, expected %s", scope, strings.Join(scopes, ", "))
+		}
+	}
+	if key.Rate <= 0 || key.Burst < 1 {
+		return APIKey{}, "", fmt.Errorf("rate must be positive and burst at least 1")
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret = "ak_" + id + "_" + secret
+
+	key.ID = id
+	key.Scopes = slices.Compact(slices.Sorted(slices.Values(key.Scopes)))
+	key.CreatedAt = time.Now()
+
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	if _, found := cs.users[key.Owner]; len(key.Owner) != 0 && !found {
+		return APIKey{}, "", ErrUnknownUser
+	}
+
+	cs.apiKeys[hashAPIKey(secret)] = &apiKey{
+		APIKey: key,
+		bucket: ratelimit.NewBucket(key.Rate, key.Burst),
+	}
+
+	return key, secret, nil
+}
+
+// ключи, отсортированные по времени выдачи
+func (cs *CalcService) ListAPIKeys() []APIKey {
+	cs.locker.RLock()
+	defer cs.locker.RUnlock()
+
+	keys := make([]APIKey, 0, len(cs.apiKeys))
+	for _, key := range cs.apiKeys {
+		keys = append(keys, key.APIKey)
+	}
+
+	slices.SortFunc(keys, func(a, b APIKey) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return keys
+}
+
+// отзываем ключ владельца owner
+func (cs *CalcService) RevokeAPIKey(owner, id string) error {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	for hash, key := range cs.apiKeys {
+		if key.ID == id && key.Owner == owner {
+			delete(cs.apiKeys, hash)
+			return nil
+		}
+	}
+
+	return ErrUnknownAPIKey
+}
+
+// ищем ключ по предъявленной строке и забираем токен из его ведра;
+// retryAfter больше нуля, если запросы с ключом надо притормозить
+func (cs *CalcService) UseAPIKey(secret string, now time.Time) (key APIKey, retryAfter time.Duration, err error) {
+	cs.locker.RLock()
+	found, ok := cs.apiKeys[hashAPIKey(secret)]
+	cs.locker.RUnlock()
+
+	if !ok {
+		return APIKey{}, 0, ErrUnknownAPIKey
+	}
+
+	if allowed, wait := found.bucket.Take(now); !allowed {
+		return found.APIKey, max(wait, time.Nanosecond), nil
+	}
+
+	return found.APIKey, 0, nil
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrDraining - оркестратор останавливается и не принимает новые выражения
+var ErrDraining = errors.New("orchestrator is shutting down")
+
+// ExpressionSnapshot - состояние незавершённого выражения
+type ExpressionSnapshot struct {
+	Expression
+	// оставшиеся токены в обратной польской записи, задачи у агентов
+	// записаны своими операндами и операциями
+	Tokens []string `json:"tokens"`
+}
+
+// перестаём принимать новые выражения
+func (cs *CalcService) Drain() {
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	cs.draining = true
+}
+
+// ждём, пока не вычислятся все выражения
+func (cs *CalcService) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for len(cs.Unfinished()) != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// снимок всех незавершённых выражений
+func (cs *CalcService) Unfinished() []ExpressionSnapshot {
+	cs.locker.RLock()
+	defer cs.locker.RUnlock()
+
+	var snapshots []ExpressionSnapshot
+	for _, expr := range cs.exprTable {
+		if expr.Status != StatusInProcess {
+			continue
+		}
+
+		snapshot := ExpressionSnapshot{Expression: *expr}
+		for el := expr.Front(); el != nil; el = el.Next() {
+			// номер задачи после остановки ни к чему не относится
+			if t, ok := el.Value.(*TaskToken); ok && t.Task != nil {
+				snapshot.Tokens = append(snapshot.Tokens, t.Task.Tokens()...)
+				continue
+			}
+			snapshot.Tokens = append(snapshot.Tokens, tokenString(el.Value.(Token)))
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	slices.SortFunc(snapshots, func(a, b ExpressionSnapshot) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return snapshots
+}
+
+func tokenString(token Token) string {
+	switch t := token.(type) {
+	case NumToken:
+		return fmt.Sprintf("%g", t.Value)
+	case OpToken:
+		return t.Value
+	case *TaskToken:
+		return fmt.Sprintf("task#%d", t.ID)
+	default:
+		return "?"
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+	"github.com/roadtoseniors/apicalc/internal/registration"
+)
+
+// задачи у агентов попадают в снимок своими операндами, а не номерами
+func TestUnfinishedTasks(t *testing.T) {
+	unaryFunctions(t)
+
+	tests := []struct {
+		name   string
+		maxOps int
+		expr   string
+		want   string
+	}{
+		{"binary operations", 1, "(1+2)*(3+4)", "1.000000 2.000000 + 3.000000 4.000000 + *"},
+		{"subtree", 2, "neg(1+2)*3", "1.000000 2.000000 + neg 3 *"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := NewCalcService(config.Config{CoarseMaxOps: tt.maxOps})
+			if err := cs.RegisterAgent(registration.Registration{ID: "agent", Workers: 1, Subtrees: true}); err != nil {
+				t.Fatal(err)
+			}
+			if err := cs.AddExpression("", "e", tt.expr); err != nil {
+				t.Fatal(err)
+			}
+			if tasks := cs.GetTasks("agent", 1); len(tasks) != 1 {
+				t.Fatalf("got %d tasks, want 1", len(tasks))
+			}
+
+			snapshots := cs.Unfinished()
+			if len(snapshots) != 1 {
+				t.Fatalf("got %d snapshots, want 1", len(snapshots))
+			}
+			if want := strings.Fields(tt.want); !slices.Equal(snapshots[0].Tokens, want) {
+				t.Fatalf("got %v, want %v", snapshots[0].Tokens, want)
+			}
+		})
+	}
+}
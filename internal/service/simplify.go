@@ -0,0 +1,148 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+)
+
+// SimplifyOptions - настройки упрощения выражения на оркестраторе
+type SimplifyOptions struct {
+	Enabled bool
+	// операции не дороже порога над двумя числами вычисляются сразу,
+	// 0 - константы не свёртываются
+	FoldThreshold time.Duration
+	// стоимость операций, обычно TIME_*_MS
+	Costs map[string]time.Duration
+	// в точном режиме 0*x не сокращается: x может оказаться Inf или NaN
+	ExactFloat bool
+}
+
+// поддерево выражения в обратной польской записи
+type fragment struct {
+	tokens []Token
+	depth  int
+}
+
+// значение поддерева, если оно состоит из одного числа
+func (f fragment) number() (float64, bool) {
+	if len(f.tokens) != 1 || f.tokens[0].Type() != TokenTypeNumber {
+		return 0, false
+	}
+
+	return f.tokens[0].(NumToken).Value, true
+}
+
+func numFragment(value float64) fragment {
+	return fragment{tokens: []Token{NumToken{value}}}
+}
+
+// упрощаем список токенов выражения, возвращаем применённые правила
+func simplify(expr *Expression, opts SimplifyOptions) []string {
+	var rewrites []string
+	stack := make([]fragment, 0, expr.Len())
+
+	for el := expr.Front(); el != nil; el = el.Next() {
+		token := el.Value.(Token)
+		if token.Type() != TokenTypeOperation {
+			stack = append(stack, fragment{tokens: []Token{token}})
+			continue
+		}
+
+		op := token.(OpToken)
+		if n := op.Arity; n != 2 {
+			// функции не упрощаются, только собираются из аргументов
+			args := stack[len(stack)-n:]
+			stack = append(stack[:len(stack)-n], joinFragments(op, args))
+			continue
+		}
+
+		right := stack[len(stack)-1]
+		left := stack[len(stack)-2]
+		stack = stack[:len(stack)-2]
+
+		res, rewrite := simplifyOp(op, left, right, opts)
+		if len(rewrite) != 0 {
+			rewrites = append(rewrites, rewrite)
+		}
+		stack = append(stack, res)
+	}
+
+	expr.Init()
+	for _, token := range stack[0].tokens {
+		expr.PushBack(token)
+	}
+	expr.Depth = stack[0].depth
+
+	return rewrites
+}
+
+// упрощаем одну операцию над двумя поддеревьями
+func simplifyOp(op OpToken, left, right fragment, opts SimplifyOptions) (fragment, string) {
+	a, leftNum := left.number()
+	b, rightNum := right.number()
+
+	// свёртка констант, если оркестратор умеет выполнять операцию
+	if leftNum && rightNum && opts.FoldThreshold > 0 {
+		info, known := operation.Lookup(op.Value)
+		cost, found := opts.Costs[op.Value]
+		if known && info.Func != nil && found && cost <= opts.FoldThreshold {
+			// считаем так же, как агент: операнды и результат проходят через строку
+			value := agentValue(info.Func(agentValue(a), agentValue(b)))
+			return numFragment(value), fmt.Sprintf("%g %s %g -> %g", a, op.Value, b, value)
+		}
+	}
+
+	switch op.Value {
+	case "+":
+		if leftNum && a == 0 {
+			return right, "0 + x -> x"
+		}
+		if rightNum && b == 0 {
+			return left, "x + 0 -> x"
+		}
+	case "-":
+		if rightNum && b == 0 {
+			return left, "x - 0 -> x"
+		}
+	case "*":
+		if leftNum && a == 1 {
+			return right, "1 * x -> x"
+		}
+		if rightNum && b == 1 {
+			return left, "x * 1 -> x"
+		}
+		if !opts.ExactFloat && leftNum && a == 0 {
+			return numFragment(0), "0 * x -> 0"
+		}
+		if !opts.ExactFloat && rightNum && b == 0 {
+			return numFragment(0), "x * 0 -> 0"
+		}
+	case "/":
+		if rightNum && b == 1 {
+			return left, "x / 1 -> x"
+		}
+	}
+
+	return joinFragments(op, []fragment{left, right}), ""
+}
+
+// число в том виде, в каком его получает и возвращает агент
+func agentValue(value float64) float64 {
+	parsed, _ := strconv.ParseFloat(formatOperand(value), 64)
+	return parsed
+}
+
+// собираем операцию над поддеревьями без упрощения
+func joinFragments(op OpToken, args []fragment) fragment {
+	var tokens []Token
+	depth := 0
+	for _, arg := range args {
+		tokens = append(tokens, arg.tokens...)
+		depth = max(depth, arg.depth)
+	}
+
+	return fragment{tokens: append(tokens, op), depth: 1 + depth}
+}
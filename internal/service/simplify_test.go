@@ -0,0 +1,108 @@
+package service
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimplify(t *testing.T) {
+	// + и - свёртываются, * и / дороже порога и остаются агентам
+	base := SimplifyOptions{
+		Enabled:       true,
+		FoldThreshold: 50 * time.Millisecond,
+		Costs: map[string]time.Duration{
+			"+": 10 * time.Millisecond,
+			"-": 10 * time.Millisecond,
+			"*": 100 * time.Millisecond,
+			"/": 100 * time.Millisecond,
+		},
+	}
+	exact := base
+	exact.ExactFloat = true
+	disabled := base
+	disabled.Enabled = false
+	// порог 0 отключает свёртку даже для бесплатных операций
+	noFold := noCostly(base)
+	noFold.FoldThreshold = 0
+
+	tests := []struct {
+		name     string
+		expr     string
+		opts     SimplifyOptions
+		want     string // токены после упрощения или результат, если вычислено
+		rewrites []string
+	}{
+		{"x + 0", "2*3+0", base, "2 3 *", []string{"x + 0 -> x"}},
+		{"0 + x", "0+2*3", base, "2 3 *", []string{"0 + x -> x"}},
+		{"x - 0", "2*3-0", base, "2 3 *", []string{"x - 0 -> x"}},
+		{"0 - x is kept", "0-2*3", base, "0 2 3 * -", nil},
+		{"1 * x", "1*(2*3)", base, "2 3 *", []string{"1 * x -> x"}},
+		{"x * 1", "(2*3)*1", base, "2 3 *", []string{"x * 1 -> x"}},
+		{"x / 1", "(2*3)/1", base, "2 3 *", []string{"x / 1 -> x"}},
+		{"1 / x is kept", "1/(2*3)", base, "1 2 3 * /", nil},
+		{"0 * x", "0*(2*3)", base, "= 0", []string{"0 * x -> 0"}},
+		{"x * 0", "(2*3)*0", base, "= 0", []string{"x * 0 -> 0"}},
+		{"exact 0 * x", "0*(2*3)", exact, "0 2 3 * *", nil},
+		{"exact x * 0", "(2*3)*0", exact, "2 3 * 0 *", nil},
+		{"exact x * 1", "(2*3)*1", exact, "2 3 *", []string{"x * 1 -> x"}},
+		{"fold", "1+2", base, "= 3", []string{"1 + 2 -> 3"}},
+		{"fold both sides", "(1+2)*(3+4)", base, "3 7 *", []string{"1 + 2 -> 3", "3 + 4 -> 7"}},
+		{"costly operation is not folded", "2*3", base, "2 3 *", nil},
+		{"fold then identity", "2*3+(1-1)", base, "2 3 *", []string{"1 - 1 -> 0", "x + 0 -> x"}},
+		{"fold to the end", "(1+2)-(4-1)+5", base, "= 5", []string{"1 + 2 -> 3", "4 - 1 -> 3", "3 - 3 -> 0", "0 + 5 -> 5"}},
+		{"disabled", "2*3+0", disabled, "2 3 * 0 +", nil},
+		{"zero threshold does not fold", "1+2", noFold, "1 2 +", nil},
+		{"zero threshold keeps identities", "2*3+0", noFold, "2 3 *", []string{"x + 0 -> x"}},
+		// агент получает операнды и возвращает результат с шестью знаками
+		{"fold with agent precision", "0.0000004+0.0000004", base, "= 0", []string{"4e-07 + 4e-07 -> 0"}},
+		{"fold rounds the result like an agent", "1/3-0.0000001", noCostly(base), "= 0.333333", []string{"1 / 3 -> 0.333333", "0.333333 - 1e-07 -> 0.333333"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, err := NewExpression("e", tt.expr, ExpressionOptions{Simplify: tt.opts})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got string
+			if expr.Status == StatusDone {
+				got = "= " + expr.Result
+			} else {
+				var tokens []string
+				for el := expr.Front(); el != nil; el = el.Next() {
+					tokens = append(tokens, tokenString(el.Value.(Token)))
+				}
+				got = strings.Join(tokens, " ")
+			}
+
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !slices.Equal(expr.Rewrites, tt.rewrites) {
+				t.Errorf("rewrites %q, want %q", expr.Rewrites, tt.rewrites)
+			}
+		})
+	}
+}
+
+// глубина считается по упрощённому выражению
+func TestSimplifyDepth(t *testing.T) {
+	opts := SimplifyOptions{Enabled: true}
+
+	expr, err := NewExpression("e", "((2*3)*1+0)/1", ExpressionOptions{Simplify: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Depth != 1 {
+		t.Fatalf("depth %d, want 1", expr.Depth)
+	}
+}
+
+// все операции дешевле порога
+func noCostly(opts SimplifyOptions) SimplifyOptions {
+	opts.Costs = map[string]time.Duration{"+": 0, "-": 0, "*": 0, "/": 0}
+	return opts
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"container/list"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+// CoarseOptions - укрупнение задач: агент получает подвыражение целиком
+type CoarseOptions struct {
+	// сколько операций можно отдать одной задачей, 1 - только по одной,
+	// 0 - поровну на воркеры агентов, умеющих вычислять подвыражения
+	MaxOps int
+	// предельная суммарная стоимость подвыражения, 0 - без ограничения
+	Budget time.Duration
+}
+
+// subtree - поддерево выражения, собранное при разборе RPN
+type subtree struct {
+	first, last *list.Element
+	ops         int
+	cost        time.Duration
+	pure        bool // только числа и операции, можно отдать агенту
+}
+
+// предел операций в задаче для выражения. Без явного предела операции
+// выражения делятся на всех воркеров: крупнее задачи - меньше обменов с
+// агентами, но не меньше задач, чем воркеров, которые могут их взять
+func (cs *CalcService) maxOps(expr *Expression) int {
+	if cs.coarse.MaxOps > 0 {
+		return cs.coarse.MaxOps
+	}
+
+	workers := 0
+	for _, agent := range cs.agents {
+		if agent.Registration.Subtrees {
+			workers += agent.Registration.Workers
+		}
+	}
+	// подвыражения некому отдать
+	if workers == 0 {
+		return 1
+	}
+
+	ops := 0
+	for el := expr.Front(); el != nil; el = el.Next() {
+		if _, ok := el.Value.(OpToken); ok {
+			ops++
+		}
+	}
+
+	return max((ops+workers-1)/workers, 1)
+}
+
+// помещается ли поддерево в одну задачу, одна операция помещается всегда
+func (cs *CalcService) fits(f subtree, maxOps int) bool {
+	if f.ops == 1 {
+		return true
+	}
+
+	if f.ops > maxOps {
+		return false
+	}
+
+	return cs.coarse.Budget == 0 || f.cost <= cs.coarse.Budget
+}
+
+// один проход по выражению: наибольшие поддеревья без задач, которые помещаются
+// в ограничения, становятся задачами. Возвращает true, если результат взят из
+// кэша и выражение нужно разобрать заново.
+func (cs *CalcService) extractPass(expr *Expression, newTasks *[]*task.Task) bool {
+	var stack []subtree
+	restart := false
+	maxOps := cs.maxOps(expr)
+
+	emit := func(f subtree) {
+		if f.pure && f.ops > 0 && cs.emitTask(expr, f, newTasks) {
+			restart = true
+		}
+	}
+
+	for el := expr.Front(); el != nil; el = el.Next() {
+		switch token := el.Value.(type) {
+		case NumToken:
+			stack = append(stack, subtree{first: el, last: el, pure: true})
+		case OpToken:
+			n := token.Arity
+			if len(stack) < n {
+				stack = append(stack, subtree{first: el, last: el})
+				continue
+			}
+
+			args := slices.Clone(stack[len(stack)-n:])
+			stack = stack[:len(stack)-n]
+
+			f := subtree{
+				first: args[0].first,
+				last:  el,
+				ops:   1,
+				cost:  cs.timeTable[token.Value],
+				pure:  true,
+			}
+			for _, arg := range args {
+				f.ops += arg.ops
+				f.cost += arg.cost
+				f.pure = f.pure && arg.pure
+			}
+			if f.pure && !cs.fits(f, maxOps) {
+				f.pure = false
+			}
+
+			// поддерево целиком не отдать, отдаём его части
+			if !f.pure {
+				for _, arg := range args {
+					emit(arg)
+				}
+			}
+			stack = append(stack, f)
+		default:
+			// результат задачи ещё не получен
+			stack = append(stack, subtree{first: el, last: el})
+		}
+	}
+
+	for _, f := range stack {
+		emit(f)
+	}
+
+	return restart
+}
+
+// заменяем поддерево задачей или результатом из кэша, true - если из кэша
+func (cs *CalcService) emitTask(expr *Expression, f subtree, newTasks *[]*task.Task) bool {
+	var tokens []string
+	for el := f.first; ; el = el.Next() {
+		switch token := el.Value.(type) {
+		case NumToken:
+			// числа записываются так же, как аргументы одиночных операций
+			tokens = append(tokens, formatOperand(token.Value))
+		case OpToken:
+			tokens = append(tokens, token.Value)
+		}
+		if el == f.last {
+			break
+		}
+	}
+
+	// одиночная бинарная операция передаётся аргументами, остальное - в RPN;
+	// три токена бывают и у вложенных унарных функций: 2 f g
+	single := f.ops == 1 && f.last.Value.(OpToken).Arity == 2
+
+	var key string
+	if single {
+		key = taskKey(tokens[2], tokens[0], tokens[1])
+	} else {
+		key = "rpn|" + strings.Join(tokens, " ")
+	}
+
+	// такое поддерево уже вычислялось
+	if value, hit := cs.cache.get(key, time.Now()); hit {
+		expr.InsertBefore(NumToken{value}, f.first)
+		removeRange(expr, f.first, f.last)
+		return true
+	}
+
+	// создаём новую задачу
+	newtask := new(task.Task)
+	newtask.ID = cs.taskID
+	cs.taskID++
+	taskElement := expr.InsertBefore(&TaskToken{ID: newtask.ID, Task: newtask}, f.first)
+	removeRange(expr, f.first, f.last)
+	cs.taskTable[newtask.ID] = ExprElement{expr.key(), taskElement}
+	cs.taskKeys[newtask.ID] = key
+
+	if single {
+		newtask.Arg1 = tokens[0]
+		newtask.Arg2 = tokens[1]
+		newtask.Operation = tokens[2]
+	} else {
+		newtask.Kind = task.KindSubtree
+		newtask.RPN = tokens
+	}
+	newtask.OperationTime = f.cost
+
+	// такая же задача уже у агентов, ждём её результата
+	if leader, found := cs.inflight[key]; found {
+		cs.followers[leader] = append(cs.followers[leader], newtask.ID)
+		cs.cache.deduplicated()
+	} else {
+		cs.inflight[key] = newtask.ID
+		*newTasks = append(*newTasks, newtask)
+	}
+
+	return false
+}
+
+// операнд задачи для агента
+func formatOperand(value float64) string {
+	return fmt.Sprintf("%f", value)
+}
+
+// удаляем элементы списка с first по last включительно
+func removeRange(expr *Expression, first, last *list.Element) {
+	for el := first; el != nil; {
+		next := el.Next()
+		expr.Remove(el)
+		if el == last {
+			break
+		}
+		el = next
+	}
+}
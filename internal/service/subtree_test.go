@@ -0,0 +1,158 @@
+package service
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+
+	"github.com/roadtoseniors/apicalc/internal/orchestrator/config"
+	"github.com/roadtoseniors/apicalc/internal/registration"
+	"github.com/roadtoseniors/apicalc/internal/task"
+)
+
+var registerUnary sync.Once
+
+// унарные функции, как у плагинов агента
+func unaryFunctions(t *testing.T) {
+	t.Helper()
+
+	registerUnary.Do(func() {
+		for _, symbol := range []string{"neg", "dbl"} {
+			err := operation.Register(operation.Operation{
+				Symbol:   symbol,
+				Arity:    1,
+				Function: true,
+				Duration: 10 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+// задачи, которые агент получит первыми
+func firstTasks(t *testing.T, maxOps, workers int, expr string) []*task.Task {
+	t.Helper()
+
+	cs := NewCalcService(config.Config{CoarseMaxOps: maxOps, CacheSize: 16, CacheTTL: time.Minute})
+	if err := cs.RegisterAgent(registration.Registration{ID: "agent", Workers: workers, Subtrees: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.AddExpression("", "e", expr); err != nil {
+		t.Fatal(err)
+	}
+
+	return cs.GetTasks("agent", 10)
+}
+
+func TestEmitTaskKinds(t *testing.T) {
+	unaryFunctions(t)
+
+	tests := []struct {
+		name   string
+		maxOps int
+		expr   string
+		want   []task.Task // только Kind, аргументы, операция и RPN
+	}{
+		{
+			name:   "binary operation",
+			maxOps: 1,
+			expr:   "2+3",
+			want:   []task.Task{{Arg1: "2.000000", Arg2: "3.000000", Operation: "+"}},
+		},
+		{
+			name:   "unary function",
+			maxOps: 1,
+			expr:   "neg(2)",
+			want:   []task.Task{{Kind: task.KindSubtree, RPN: []string{"2.000000", "neg"}}},
+		},
+		{
+			name:   "nested unary functions",
+			maxOps: 2,
+			expr:   "dbl(neg(2))",
+			want:   []task.Task{{Kind: task.KindSubtree, RPN: []string{"2.000000", "neg", "dbl"}}},
+		},
+		{
+			name:   "nested unary functions one by one",
+			maxOps: 1,
+			expr:   "dbl(neg(2))",
+			want:   []task.Task{{Kind: task.KindSubtree, RPN: []string{"2.000000", "neg"}}},
+		},
+		{
+			name:   "unary function of binary operation",
+			maxOps: 2,
+			expr:   "neg(2+3)",
+			want:   []task.Task{{Kind: task.KindSubtree, RPN: []string{"2.000000", "3.000000", "+", "neg"}}},
+		},
+		{
+			name:   "binary operation of unary functions",
+			maxOps: 1,
+			expr:   "neg(2)*dbl(3)",
+			want: []task.Task{
+				{Kind: task.KindSubtree, RPN: []string{"2.000000", "neg"}},
+				{Kind: task.KindSubtree, RPN: []string{"3.000000", "dbl"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := firstTasks(t, tt.maxOps, 1, tt.expr)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d tasks, want %d", len(got), len(tt.want))
+			}
+
+			for i, want := range tt.want {
+				g := got[i]
+				if g.Kind != want.Kind || g.Arg1 != want.Arg1 || g.Arg2 != want.Arg2 ||
+					g.Operation != want.Operation || !slices.Equal(g.RPN, want.RPN) {
+					t.Errorf("task %d: got kind %q %q %q %q rpn %v, want kind %q %q %q %q rpn %v", i,
+						g.Kind, g.Arg1, g.Arg2, g.Operation, g.RPN,
+						want.Kind, want.Arg1, want.Arg2, want.Operation, want.RPN)
+				}
+			}
+		})
+	}
+}
+
+// без явного предела операции выражения делятся на воркеров агентов
+func TestAutoMaxOps(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		expr    string
+		want    [][]string // RPN задач, одиночные операции - аргументы и операция
+	}{
+		{"one worker takes the whole expression", 1, "(1+2)*(3+4)",
+			[][]string{{"1.000000", "2.000000", "+", "3.000000", "4.000000", "+", "*"}}},
+		{"two workers take a half each", 2, "(1+2)*(3+4)",
+			[][]string{{"1.000000", "2.000000", "+"}, {"3.000000", "4.000000", "+"}}},
+		{"more workers than operations", 8, "(1+2)*(3+4)",
+			[][]string{{"1.000000", "2.000000", "+"}, {"3.000000", "4.000000", "+"}}},
+		{"two workers and a chain", 2, "(1+2+3)*(4+5+6)",
+			[][]string{{"1.000000", "2.000000", "+", "3.000000", "+"}, {"4.000000", "5.000000", "+", "6.000000", "+"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := firstTasks(t, 0, tt.workers, tt.expr)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d tasks, want %d", len(got), len(tt.want))
+			}
+
+			for i, want := range tt.want {
+				rpn := got[i].RPN
+				if got[i].Kind == task.KindOperation {
+					rpn = []string{got[i].Arg1, got[i].Arg2, got[i].Operation}
+				}
+				if !slices.Equal(rpn, want) {
+					t.Errorf("task %d: %v, want %v", i, rpn, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrUserExists - логин уже занят
+	ErrUserExists = errors.New("user already exists")
+	// ErrBadCredentials - нет такого пользователя или пароль не подходит
+	ErrBadCredentials = errors.New("invalid login or password")
+)
+
+// логин входит в ключ выражения, поэтому без "/" и пробелов
+var loginPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+const minPasswordLength = 8
+
+// пользователь публичного API
+type user struct {
+	login        string
+	passwordHash []byte
+	createdAt    time.Time
+}
+
+// хэш для сравнения, когда пользователя нет: ответ не выдаёт, существует ли логин
+var absentUserHash, _ = bcrypt.GenerateFromPassword([]byte("absent user"), bcrypt.DefaultCost)
+
+// регистрируем пользователя
+func (cs *CalcService) RegisterUser(login, password string) error {
+	if !loginPattern.MatchString(login) {
+		return fmt.Errorf("login must be 1-64 letters, digits, '_', '.' or '-'")
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	// bcrypt учитывает только первые 72 байта
+	if len(password) > 72 {
+		return fmt.Errorf("password must be at most 72 bytes")
+	}
+
+	// хэширование медленное, считаем его без блокировки
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	cs.locker.Lock()
+	defer cs.locker.Unlock()
+
+	if _, found := cs.users[login]; found {
+		return ErrUserExists
+	}
+
+	cs.users[login] = &user{
+		login:        login,
+		passwordHash: hash,
+		createdAt:    time.Now(),
+	}
+
+	return nil
+}
+
+// проверяем пароль пользователя
+func (cs *CalcService) CheckPassword(login, password string) error {
+	cs.locker.RLock()
+	hash := absentUserHash
+	u, found := cs.users[login]
+	if found {
+		hash = u.passwordHash
+	}
+	cs.locker.RUnlock()
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || !found {
+		return ErrBadCredentials
+	}
+
+	return nil
+}
+
+// exprID - ключ выражения в таблице: у разных пользователей ID могут совпадать,
+// а склейка строк путала бы владельца "a" с ID "b/c" и владельца "a/b" с ID "c"
+type exprID struct {
+	owner, id string
+}
+
+func exprKey(owner, id string) exprID {
+	return exprID{owner: owner, id: id}
+}
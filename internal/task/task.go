@@ -1,6 +1,16 @@
 package task
 
-import "time"
+import (
+	"slices"
+	"strconv"
+	"time"
+)
+
+// виды задач
+const (
+	KindOperation = ""        // одна бинарная операция над Arg1 и Arg2
+	KindSubtree   = "subtree" // подвыражение в RPN, вычисляется агентом целиком
+)
 
 type Task struct {
 	ID            int64         `json:"id"`
@@ -8,4 +18,34 @@ type Task struct {
 	Arg2          string        `json:"arg2"`
 	Operation     string        `json:"operation"`
 	OperationTime time.Duration `json:"operation_time"`
-}
\ No newline at end of file
+
+	Kind string `json:"kind,omitempty"`
+	// подвыражение для задач KindSubtree, OperationTime - его суммарная стоимость
+	RPN []string `json:"rpn,omitempty"`
+}
+
+// Tokens возвращает задачу в обратной польской записи.
+func (t Task) Tokens() []string {
+	if t.Kind == KindSubtree {
+		return slices.Clone(t.RPN)
+	}
+
+	return []string{t.Arg1, t.Arg2, t.Operation}
+}
+
+// Operations возвращает операции, которые нужны для выполнения задачи.
+func (t Task) Operations() []string {
+	if t.Kind != KindSubtree {
+		return []string{t.Operation}
+	}
+
+	// в RPN задачи нет ничего, кроме чисел и операций
+	var ops []string
+	for _, token := range t.RPN {
+		if _, err := strconv.ParseFloat(token, 64); err != nil && !slices.Contains(ops, token) {
+			ops = append(ops, token)
+		}
+	}
+
+	return ops
+}
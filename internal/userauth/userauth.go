@@ -0,0 +1,74 @@
+// Package userauth выдаёт и проверяет JWT пользователей публичного API.
+package userauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidToken - токен не подписан нами, просрочен или повреждён
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+const issuer = "apicalc"
+
+// Issuer подписывает токены общим секретом по HS256.
+type Issuer struct {
+	Secret []byte
+	TTL    time.Duration // время жизни токена
+}
+
+// Issue выдаёт токен пользователю login.
+func (iss Issuer) Issue(login string, now time.Time) (string, time.Time, error) {
+	expires := now.Add(iss.TTL)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    issuer,
+		Subject:   login,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expires),
+	})
+
+	signed, err := token.SignedString(iss.Secret)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("sign token: %w", err)
+	}
+
+	return signed, expires, nil
+}
+
+// Parse проверяет токен и возвращает логин пользователя.
+func (iss Issuer) Parse(signed string) (string, error) {
+	var claims jwt.RegisteredClaims
+
+	_, err := jwt.ParseWithClaims(
+		signed,
+		&claims,
+		func(*jwt.Token) (any, error) { return iss.Secret, nil },
+		// алгоритм фиксирован, чтобы нельзя было подсунуть токен с "none"
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil || len(claims.Subject) == 0 {
+		return "", ErrInvalidToken
+	}
+
+	return claims.Subject, nil
+}
+
+type userKey struct{}
+
+// WithUser запоминает пользователя запроса в контексте.
+func WithUser(ctx context.Context, login string) context.Context {
+	return context.WithValue(ctx, userKey{}, login)
+}
+
+// User - пользователь запроса, пусто - авторизация выключена.
+func User(ctx context.Context) string {
+	login, _ := ctx.Value(userKey{}).(string)
+	return login
+}
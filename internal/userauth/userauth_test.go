@@ -0,0 +1,83 @@
+package userauth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// токен с заданными полями, подписанный ключом key
+func sign(t *testing.T, method jwt.SigningMethod, key any, claims jwt.RegisteredClaims) string {
+	t.Helper()
+
+	signed, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestParse(t *testing.T) {
+	iss := Issuer{Secret: []byte("secret"), TTL: time.Hour}
+	now := time.Now()
+
+	valid := jwt.RegisteredClaims{
+		Issuer:    issuer,
+		Subject:   "alice",
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	with := func(change func(*jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		claims := valid
+		change(&claims)
+		return claims
+	}
+
+	issued, _, err := iss.Issue("alice", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := iss.Issue("alice", now.Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, _, err := Issuer{Secret: []byte("other secret"), TTL: time.Hour}.Issue("alice", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		signed string
+		want   string // пусто - токен отвергается
+	}{
+		{"issued token", issued, "alice"},
+		{"alg none", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid), ""},
+		{"other HMAC algorithm", sign(t, jwt.SigningMethodHS512, iss.Secret, valid), ""},
+		{"expired", expired, ""},
+		{"without expiration", sign(t, jwt.SigningMethodHS256, iss.Secret, with(func(c *jwt.RegisteredClaims) { c.ExpiresAt = nil })), ""},
+		{"wrong issuer", sign(t, jwt.SigningMethodHS256, iss.Secret, with(func(c *jwt.RegisteredClaims) { c.Issuer = "other" })), ""},
+		{"wrong secret", foreign, ""},
+		{"without subject", sign(t, jwt.SigningMethodHS256, iss.Secret, with(func(c *jwt.RegisteredClaims) { c.Subject = "" })), ""},
+		{"garbage", "not a token", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login, err := iss.Parse(tt.signed)
+			if len(tt.want) == 0 {
+				if !errors.Is(err, ErrInvalidToken) || len(login) != 0 {
+					t.Fatalf("got %q, %v, want %v", login, err, ErrInvalidToken)
+				}
+				return
+			}
+
+			if err != nil || login != tt.want {
+				t.Fatalf("got %q, %v, want %q", login, err, tt.want)
+			}
+		})
+	}
+}
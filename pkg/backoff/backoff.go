@@ -0,0 +1,72 @@
+package backoff
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff - экспоненциальная задержка между повторными попытками
+type Backoff struct {
+	Base time.Duration // задержка перед первым повтором
+	Max  time.Duration // верхняя граница задержки
+}
+
+// Delay возвращает задержку перед попыткой attempt (с нуля).
+// Половина задержки случайна, чтобы агенты не повторяли запросы одновременно.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Base
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	d = min(d, b.Max)
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// Permanent помечает ошибку, после которой повторять попытку бессмысленно.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent сообщает, помечена ли ошибка как Permanent.
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+// Retry вызывает fn, пока она не выполнится успешно, не вернёт Permanent
+// или не закончатся попытки. Возвращает последнюю ошибку и число повторов.
+func Retry(attempts int, b Backoff, fn func() error) (int, error) {
+	var err error
+
+	for attempt := 0; attempt < max(attempts, 1); attempt++ {
+		if attempt > 0 {
+			time.Sleep(b.Delay(attempt - 1))
+		}
+
+		err = fn()
+
+		if err == nil || IsPermanent(err) {
+			return attempt, err
+		}
+	}
+
+	return max(attempts, 1) - 1, err
+}
@@ -0,0 +1,108 @@
+package backoff
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	b := Backoff{Base: 100 * time.Millisecond, Max: time.Second}
+
+	tests := []struct {
+		attempt int
+		full    time.Duration // задержка без случайной части
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{2, 400 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{100, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			for range 100 {
+				d := b.Delay(tt.attempt)
+				if d < tt.full/2 || d > tt.full {
+					t.Fatalf("delay %v, want between %v and %v", d, tt.full/2, tt.full)
+				}
+			}
+		})
+	}
+}
+
+func TestDelayZero(t *testing.T) {
+	for _, b := range []Backoff{{}, {Max: time.Second}, {Base: time.Second}} {
+		if d := b.Delay(3); d != 0 {
+			t.Fatalf("%+v: delay %v, want 0", b, d)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	errTemporary := errors.New("temporary")
+	errRejected := errors.New("rejected")
+
+	tests := []struct {
+		name     string
+		attempts int
+		results  []error // ошибки вызовов по порядку, дальше - успех
+		calls    int
+		retries  int
+		wantErr  error
+	}{
+		{"success", 3, nil, 1, 0, nil},
+		{"success after retries", 3, []error{errTemporary, errTemporary}, 3, 2, nil},
+		{"attempts exhausted", 3, []error{errTemporary, errTemporary, errTemporary, errTemporary}, 3, 2, errTemporary},
+		{"permanent stops early", 5, []error{errTemporary, Permanent(errRejected)}, 2, 1, errRejected},
+		{"at least one attempt", 0, []error{errTemporary}, 1, 0, errTemporary},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			retries, err := Retry(tt.attempts, Backoff{Base: time.Microsecond, Max: time.Millisecond}, func() error {
+				calls++
+				if calls <= len(tt.results) {
+					return tt.results[calls-1]
+				}
+				return nil
+			})
+
+			if calls != tt.calls || retries != tt.retries || !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("calls %d, retries %d, err %v; want %d, %d, %v", calls, retries, err, tt.calls, tt.retries, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	base := errors.New("bad request")
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", base, false},
+		{"permanent", Permanent(base), true},
+		{"wrapped permanent", fmt.Errorf("send: %w", Permanent(base)), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.want {
+				t.Fatalf("IsPermanent(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+
+	// сообщение и цепочка ошибок сохраняются
+	if err := Permanent(base); err.Error() != base.Error() || !errors.Is(err, base) {
+		t.Fatalf("Permanent changed the error: %v", err)
+	}
+}
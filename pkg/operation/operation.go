@@ -0,0 +1,232 @@
+package operation
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Associativity - как группируются одинаковые операции подряд
+type Associativity int
+
+const (
+	Left  Associativity = iota // (a op b) op c
+	Right                      // a op (b op c)
+	Full                       // группировка не влияет на результат
+)
+
+// Operation описывает операцию: как её разбирать, планировать и вычислять.
+type Operation struct {
+	Symbol        string
+	Arity         int
+	Precedence    int // чем больше, тем раньше выполняется
+	Associativity Associativity
+	Commutative   bool          // порядок операндов не влияет на результат
+	Duration      time.Duration // время выполнения по умолчанию
+	// вызывается как функция: npv(r, a, b), иначе это инфиксный оператор
+	Function bool
+	// реализация, nil - операцию выполняют только агенты
+	Func func(args ...float64) float64
+}
+
+// Registry - набор операций. Реестр с базовым видит и операции базового,
+// но добавляет и удаляет только свои.
+type Registry struct {
+	base       *Registry
+	locker     sync.RWMutex
+	operations map[string]Operation
+}
+
+// NewRegistry создаёт реестр поверх base, nil - пустой реестр.
+func NewRegistry(base *Registry) *Registry {
+	return &Registry{
+		base:       base,
+		operations: make(map[string]Operation),
+	}
+}
+
+// общий реестр встроенных операций и операций плагинов
+var global = NewRegistry(nil)
+
+// Global возвращает общий реестр.
+func Global() *Registry {
+	return global
+}
+
+func init() {
+	for _, op := range []Operation{
+		{
+			Symbol:        "+",
+			Arity:         2,
+			Precedence:    1,
+			Associativity: Full,
+			Commutative:   true,
+			Duration:      100 * time.Millisecond,
+			Func:          func(args ...float64) float64 { return args[0] + args[1] },
+		},
+		{
+			Symbol:        "-",
+			Arity:         2,
+			Precedence:    1,
+			Associativity: Left,
+			Duration:      100 * time.Millisecond,
+			Func:          func(args ...float64) float64 { return args[0] - args[1] },
+		},
+		{
+			Symbol:        "*",
+			Arity:         2,
+			Precedence:    2,
+			Associativity: Full,
+			Commutative:   true,
+			Duration:      100 * time.Millisecond,
+			Func:          func(args ...float64) float64 { return args[0] * args[1] },
+		},
+		{
+			Symbol:        "/",
+			Arity:         2,
+			Precedence:    2,
+			Associativity: Left,
+			Duration:      100 * time.Millisecond,
+			Func:          func(args ...float64) float64 { return args[0] / args[1] },
+		},
+	} {
+		if err := Register(op); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Register добавляет операцию в общий реестр.
+func Register(op Operation) error {
+	return global.Register(op)
+}
+
+// Lookup ищет операцию в общем реестре.
+func Lookup(symbol string) (Operation, bool) {
+	return global.Lookup(symbol)
+}
+
+// IsOperation сообщает, есть ли операция в общем реестре.
+func IsOperation(symbol string) bool {
+	return global.IsOperation(symbol)
+}
+
+// Symbols возвращает символы операций общего реестра.
+func Symbols() []string {
+	return global.Symbols()
+}
+
+// All возвращает все операции общего реестра.
+func All() []Operation {
+	return global.All()
+}
+
+// Register добавляет операцию в реестр.
+func (r *Registry) Register(op Operation) error {
+	if len(op.Symbol) == 0 {
+		return fmt.Errorf("empty operation symbol")
+	}
+	if !op.Function && op.Arity != 2 {
+		return fmt.Errorf("operator %q must be binary", op.Symbol)
+	}
+	if op.Function && op.Arity < 1 {
+		return fmt.Errorf("function %q must take at least one argument", op.Symbol)
+	}
+	if op.Function && !isName(op.Symbol) {
+		return fmt.Errorf("function name %q must consist of letters, digits and '_'", op.Symbol)
+	}
+
+	if _, found := r.Lookup(op.Symbol); found {
+		return fmt.Errorf("operation %q already registered", op.Symbol)
+	}
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	if _, found := r.operations[op.Symbol]; found {
+		return fmt.Errorf("operation %q already registered", op.Symbol)
+	}
+	r.operations[op.Symbol] = op
+
+	return nil
+}
+
+// Remove удаляет операцию, добавленную в этот реестр.
+// Операции базового реестра не удаляются.
+func (r *Registry) Remove(symbol string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	delete(r.operations, symbol)
+}
+
+// имя функции: буквы, цифры и '_', начинается не с цифры
+func isName(symbol string) bool {
+	for i, r := range symbol {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Lookup ищет операцию по символу, сначала в этом реестре, потом в базовом.
+func (r *Registry) Lookup(symbol string) (Operation, bool) {
+	r.locker.RLock()
+	op, found := r.operations[symbol]
+	r.locker.RUnlock()
+
+	if !found && r.base != nil {
+		return r.base.Lookup(symbol)
+	}
+
+	return op, found
+}
+
+// IsOperation сообщает, известна ли реестру операция с таким символом.
+func (r *Registry) IsOperation(symbol string) bool {
+	_, found := r.Lookup(symbol)
+	return found
+}
+
+// Symbols возвращает символы всех операций, длинные раньше коротких,
+// чтобы при разборе "**" не распалось на два "*".
+func (r *Registry) Symbols() []string {
+	var symbols []string
+	for _, op := range r.All() {
+		symbols = append(symbols, op.Symbol)
+	}
+
+	slices.SortFunc(symbols, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(b) - len(a)
+		}
+		return strings.Compare(a, b)
+	})
+
+	return symbols
+}
+
+// All возвращает все операции вместе с операциями базового реестра.
+func (r *Registry) All() []Operation {
+	var all []Operation
+	if r.base != nil {
+		all = r.base.All()
+	}
+
+	r.locker.RLock()
+	for _, op := range r.operations {
+		all = append(all, op)
+	}
+	r.locker.RUnlock()
+
+	slices.SortFunc(all, func(a, b Operation) int {
+		return strings.Compare(a.Symbol, b.Symbol)
+	})
+
+	return all
+}
@@ -0,0 +1,124 @@
+package operation
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      Operation
+		wantErr string
+	}{
+		{"operator", Operation{Symbol: "%%", Arity: 2, Precedence: 2}, ""},
+		{"function", Operation{Symbol: "hypot_test", Arity: 2, Function: true}, ""},
+		{"function with digits", Operation{Symbol: "log2_test", Arity: 1, Function: true}, ""},
+		{"empty symbol", Operation{Arity: 2}, "empty operation symbol"},
+		{"unary operator", Operation{Symbol: "!", Arity: 1}, "must be binary"},
+		{"ternary operator", Operation{Symbol: "?", Arity: 3}, "must be binary"},
+		{"function without arguments", Operation{Symbol: "now_test", Function: true}, "at least one argument"},
+		{"function name with a dash", Operation{Symbol: "a-b", Arity: 1, Function: true}, "letters, digits"},
+		{"function name starting with a digit", Operation{Symbol: "2x", Arity: 1, Function: true}, "letters, digits"},
+		{"duplicate", Operation{Symbol: "+", Arity: 2}, "already registered"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Register(tt.op)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, found := Lookup(tt.op.Symbol); !found || got.Arity != tt.op.Arity {
+					t.Fatalf("lookup %q: %+v, %t", tt.op.Symbol, got, found)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+			if len(tt.op.Symbol) != 0 && tt.op.Symbol != "+" && IsOperation(tt.op.Symbol) {
+				t.Fatalf("%q registered despite the error", tt.op.Symbol)
+			}
+		})
+	}
+}
+
+func TestBuiltinOperations(t *testing.T) {
+	tests := []struct {
+		symbol string
+		a, b   float64
+		want   float64
+	}{
+		{"+", 2, 3, 5},
+		{"-", 2, 3, -1},
+		{"*", 2, 3, 6},
+		{"/", 3, 2, 1.5},
+	}
+
+	for _, tt := range tests {
+		op, found := Lookup(tt.symbol)
+		if !found {
+			t.Fatalf("%q is not registered", tt.symbol)
+		}
+		if got := op.Func(tt.a, tt.b); got != tt.want {
+			t.Errorf("%g %s %g = %g, want %g", tt.a, tt.symbol, tt.b, got, tt.want)
+		}
+	}
+}
+
+// длинные символы раньше коротких, чтобы "**" не распалось на два "*"
+func TestSymbolsLongestFirst(t *testing.T) {
+	if err := Register(Operation{Symbol: "**", Arity: 2, Precedence: 3, Associativity: Right}); err != nil {
+		t.Fatal(err)
+	}
+
+	symbols := Symbols()
+	if slices.Index(symbols, "**") > slices.Index(symbols, "*") {
+		t.Fatalf("%q after %q in %v", "**", "*", symbols)
+	}
+	for i := 1; i < len(symbols); i++ {
+		if len(symbols[i-1]) < len(symbols[i]) {
+			t.Fatalf("%q before longer %q", symbols[i-1], symbols[i])
+		}
+	}
+
+	all := All()
+	if !slices.IsSortedFunc(all, func(a, b Operation) int { return strings.Compare(a.Symbol, b.Symbol) }) {
+		t.Fatal("All is not sorted by symbol")
+	}
+}
+
+// реестр поверх общего видит его операции, но свои держит при себе
+func TestRegistryOverlay(t *testing.T) {
+	overlay := NewRegistry(Global())
+
+	if _, found := overlay.Lookup("+"); !found {
+		t.Fatal("base operation is not visible")
+	}
+	if err := overlay.Register(Operation{Symbol: "+", Arity: 2}); err == nil {
+		t.Fatal("base operation registered again")
+	}
+
+	if err := overlay.Register(Operation{Symbol: "npv_overlay", Arity: 3, Function: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !overlay.IsOperation("npv_overlay") || !slices.Contains(overlay.Symbols(), "npv_overlay") {
+		t.Fatal("own operation is not visible")
+	}
+	if IsOperation("npv_overlay") {
+		t.Fatal("own operation leaked into the base registry")
+	}
+
+	overlay.Remove("+")
+	overlay.Remove("npv_overlay")
+	if overlay.IsOperation("npv_overlay") {
+		t.Fatal("removed operation is still visible")
+	}
+	if !overlay.IsOperation("+") {
+		t.Fatal("base operation removed through the overlay")
+	}
+}
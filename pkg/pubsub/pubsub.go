@@ -0,0 +1,76 @@
+package pubsub
+
+import "sync"
+
+// Hub - рассылка сообщений подписчикам. Publish не блокируется: подписчик,
+// чей буфер переполнен, отключается, и его канал закрывается.
+type Hub[T any] struct {
+	locker sync.Mutex
+	subs   map[*Subscription[T]]struct{}
+	buffer int
+}
+
+// Subscription - подписка на сообщения, которые проходят фильтр
+type Subscription[T any] struct {
+	C <-chan T // закрывается после Close или при отключении медленного подписчика
+
+	ch     chan T
+	filter func(T) bool
+	hub    *Hub[T]
+}
+
+// NewHub создаёт хаб, buffer - сколько сообщений ждут чтения у каждого подписчика
+func NewHub[T any](buffer int) *Hub[T] {
+	return &Hub[T]{
+		subs:   make(map[*Subscription[T]]struct{}),
+		buffer: buffer,
+	}
+}
+
+// Subscribe подписывает на сообщения, для которых filter возвращает true, nil - на все
+func (h *Hub[T]) Subscribe(filter func(T) bool) *Subscription[T] {
+	ch := make(chan T, h.buffer)
+	sub := &Subscription[T]{C: ch, ch: ch, filter: filter, hub: h}
+
+	h.locker.Lock()
+	h.subs[sub] = struct{}{}
+	h.locker.Unlock()
+
+	return sub
+}
+
+// Publish отправляет сообщение подписчикам
+func (h *Hub[T]) Publish(msg T) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	for sub := range h.subs {
+		if sub.filter != nil && !sub.filter(msg) {
+			continue
+		}
+
+		select {
+		case sub.ch <- msg:
+		default:
+			// подписчик не успевает, пропуск сообщения он бы не заметил
+			h.remove(sub)
+		}
+	}
+}
+
+// Close отписывает, повторный вызов ничего не делает
+func (s *Subscription[T]) Close() {
+	s.hub.locker.Lock()
+	defer s.hub.locker.Unlock()
+
+	s.hub.remove(s)
+}
+
+func (h *Hub[T]) remove(sub *Subscription[T]) {
+	if _, found := h.subs[sub]; !found {
+		return
+	}
+
+	delete(h.subs, sub)
+	close(sub.ch)
+}
@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"slices"
+	"testing"
+)
+
+// читаем всё, что уже лежит в канале, и проверяем, закрыт ли он
+func drain[T any](sub *Subscription[T]) ([]T, bool) {
+	var msgs []T
+	for {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				return msgs, true
+			}
+			msgs = append(msgs, msg)
+		default:
+			return msgs, false
+		}
+	}
+}
+
+func TestPublishFilter(t *testing.T) {
+	hub := NewHub[int](10)
+	all := hub.Subscribe(nil)
+	even := hub.Subscribe(func(n int) bool { return n%2 == 0 })
+
+	for n := range 5 {
+		hub.Publish(n)
+	}
+
+	if msgs, closed := drain(all); closed || !slices.Equal(msgs, []int{0, 1, 2, 3, 4}) {
+		t.Fatalf("all: %v, closed %v", msgs, closed)
+	}
+	if msgs, closed := drain(even); closed || !slices.Equal(msgs, []int{0, 2, 4}) {
+		t.Fatalf("even: %v, closed %v", msgs, closed)
+	}
+}
+
+// медленный подписчик отключается, остальные продолжают получать сообщения
+func TestSlowSubscriberDisconnected(t *testing.T) {
+	hub := NewHub[int](2)
+	slow := hub.Subscribe(nil)
+	fast := hub.Subscribe(nil)
+
+	// Publish не блокируется, хотя slow ничего не читает
+	for n := range 6 {
+		hub.Publish(n)
+		if n%2 == 1 {
+			drain(fast)
+		}
+	}
+
+	msgs, closed := drain(slow)
+	if !closed || !slices.Equal(msgs, []int{0, 1}) {
+		t.Fatalf("slow: %v, closed %v", msgs, closed)
+	}
+
+	hub.Publish(6)
+	if msgs, closed := drain(fast); closed || !slices.Equal(msgs, []int{6}) {
+		t.Fatalf("fast: %v, closed %v", msgs, closed)
+	}
+
+	// отключённый подписчик может вызвать Close
+	slow.Close()
+}
+
+// сообщения, не прошедшие фильтр, не занимают буфер
+func TestFilteredMessagesDoNotOverflow(t *testing.T) {
+	hub := NewHub[int](1)
+	sub := hub.Subscribe(func(n int) bool { return n == 42 })
+
+	for n := range 10 {
+		hub.Publish(n)
+	}
+	hub.Publish(42)
+
+	if msgs, closed := drain(sub); closed || !slices.Equal(msgs, []int{42}) {
+		t.Fatalf("got %v, closed %v", msgs, closed)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	hub := NewHub[int](1)
+	sub := hub.Subscribe(nil)
+
+	sub.Close()
+	sub.Close()
+
+	if _, closed := drain(sub); !closed {
+		t.Fatal("channel is not closed")
+	}
+
+	// после отписки сообщения не отправляются
+	hub.Publish(1)
+	if len(hub.subs) != 0 {
+		t.Fatalf("%d subscribers left", len(hub.subs))
+	}
+}
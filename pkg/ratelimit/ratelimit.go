@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket - ведро токенов: Rate запросов в секунду с запасом Burst
+type Bucket struct {
+	Rate  float64 // сколько токенов добавляется в секунду, больше нуля
+	Burst int     // вместимость ведра
+
+	locker sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{
+		Rate:   rate,
+		Burst:  burst,
+		tokens: float64(burst),
+	}
+}
+
+// Take забирает токен. Если токенов нет, возвращает false и время до появления следующего.
+func (b *Bucket) Take(now time.Time) (bool, time.Duration) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	}
+	b.tokens = min(b.tokens, float64(b.Burst))
+	if now.After(b.last) {
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.Rate * float64(time.Second))
+}
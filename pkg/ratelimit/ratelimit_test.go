@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// шаги выполняются по порядку на одном ведре: 2 токена в секунду, запас 3
+	steps := []struct {
+		name  string
+		at    time.Duration
+		ok    bool
+		retry time.Duration
+	}{
+		{"burst 1", 0, true, 0},
+		{"burst 2", 0, true, 0},
+		{"burst 3", 0, true, 0},
+		{"empty", 0, false, 500 * time.Millisecond},
+		{"half a token", 250 * time.Millisecond, false, 250 * time.Millisecond},
+		{"refilled", 500 * time.Millisecond, true, 0},
+		{"empty again", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		// часы пошли назад: токены не добавляются
+		{"clock went back", 100 * time.Millisecond, false, 500 * time.Millisecond},
+		// за долгий простой ведро наполняется не больше чем до Burst
+		{"idle 1", 10 * time.Second, true, 0},
+		{"idle 2", 10 * time.Second, true, 0},
+		{"idle 3", 10 * time.Second, true, 0},
+		{"idle capped", 10 * time.Second, false, 500 * time.Millisecond},
+	}
+
+	b := NewBucket(2, 3)
+	for _, step := range steps {
+		ok, retry := b.Take(start.Add(step.at))
+		if ok != step.ok || retry != step.retry {
+			t.Fatalf("%s: got (%v, %v), want (%v, %v)", step.name, ok, retry, step.ok, step.retry)
+		}
+	}
+}
+
+// при Rate меньше единицы следующий токен ждать дольше секунды
+func TestBucketSlowRate(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b := NewBucket(0.25, 1)
+	if ok, _ := b.Take(start); !ok {
+		t.Fatal("first take failed")
+	}
+
+	ok, retry := b.Take(start.Add(time.Second))
+	if ok || retry != 3*time.Second {
+		t.Fatalf("got (%v, %v), want (false, 3s)", ok, retry)
+	}
+
+	if ok, _ := b.Take(start.Add(4 * time.Second)); !ok {
+		t.Fatal("take after refill failed")
+	}
+}
@@ -0,0 +1,177 @@
+package rpn
+
+import (
+	"container/heap"
+	"fmt"
+	"slices"
+
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+)
+
+// узел дерева выражения
+type node struct {
+	value string
+	args  []*node // операнды, у числа их нет
+	depth int     // количество последовательных раундов вычисления
+}
+
+// узел с глубиной, посчитанной по операндам
+func newNode(value string, args ...*node) *node {
+	n := &node{value: value, args: args}
+	for _, arg := range args {
+		n.depth = max(n.depth, arg.depth+1)
+	}
+
+	return n
+}
+
+// обход дерева в обратную польскую запись
+func (n *node) appendRPN(rpnarr []string) []string {
+	for _, arg := range n.args {
+		rpnarr = arg.appendRPN(rpnarr)
+	}
+
+	return append(rpnarr, n.value)
+}
+
+// строим дерево из обратной польской записи
+func buildTree(rpnarr []string, ops *operation.Registry) (*node, error) {
+	nodes := make([]*node, 0, len(rpnarr))
+
+	for _, token := range rpnarr {
+		info, found := ops.Lookup(token)
+		if !found {
+			nodes = append(nodes, newNode(token))
+			continue
+		}
+
+		if len(nodes) < info.Arity {
+			return nil, fmt.Errorf("not enough operands for '%s'", token)
+		}
+
+		args := slices.Clone(nodes[len(nodes)-info.Arity:])
+		nodes = append(nodes[:len(nodes)-info.Arity], newNode(token, args...))
+	}
+
+	if len(nodes) != 1 {
+		return nil, fmt.Errorf("incorrect expression")
+	}
+
+	return nodes[0], nil
+}
+
+// можно ли переставлять операнды оператора
+func isReassociable(op string, ops *operation.Registry) bool {
+	// операнды переставляются, поэтому нужна и коммутативность
+	info, found := ops.Lookup(op)
+	return found && info.Associativity == operation.Full && info.Commutative
+}
+
+// собираем операнды цепочки одинаковых операторов
+func (n *node) collect(op string, operands []*node) []*node {
+	if n.value != op || len(n.args) == 0 {
+		return append(operands, n)
+	}
+
+	for _, arg := range n.args {
+		operands = arg.collect(op, operands)
+	}
+
+	return operands
+}
+
+// балансируем дерево
+func balance(n *node, ops *operation.Registry) *node {
+	if len(n.args) == 0 {
+		return n
+	}
+
+	if !isReassociable(n.value, ops) {
+		args := make([]*node, len(n.args))
+		for i, arg := range n.args {
+			args[i] = balance(arg, ops)
+		}
+		return newNode(n.value, args...)
+	}
+
+	operands := n.collect(n.value, nil)
+	h := make(operandHeap, len(operands))
+	for i, operand := range operands {
+		h[i] = operandAt{node: balance(operand, ops), pos: i}
+	}
+	heap.Init(&h)
+
+	// каждый раз объединяем два самых мелких поддерева,
+	// так итоговая глубина получается минимальной
+	for h.Len() > 1 {
+		a := heap.Pop(&h).(operandAt)
+		b := heap.Pop(&h).(operandAt)
+		if b.pos < a.pos {
+			a, b = b, a
+		}
+		heap.Push(&h, operandAt{node: newNode(n.value, a.node, b.node), pos: a.pos})
+	}
+
+	return h[0].node
+}
+
+// операнд цепочки и его место в ней, объединённые поддеревья
+// остаются на месте левого, чтобы порядок операндов сохранялся
+type operandAt struct {
+	node *node
+	pos  int
+}
+
+// операнды по возрастанию глубины, при равной глубине - по порядку в цепочке
+type operandHeap []operandAt
+
+func (h operandHeap) Len() int { return len(h) }
+
+func (h operandHeap) Less(i, j int) bool {
+	if h[i].node.depth != h[j].node.depth {
+		return h[i].node.depth < h[j].node.depth
+	}
+	return h[i].pos < h[j].pos
+}
+
+func (h operandHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *operandHeap) Push(x any) { *h = append(*h, x.(operandAt)) }
+
+func (h *operandHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Rebalance перестраивает цепочки ассоциативных и коммутативных операторов
+// в сбалансированные деревья, чтобы их можно было вычислять параллельно.
+func Rebalance(rpnarr []string) ([]string, error) {
+	return RebalanceWith(rpnarr, operation.Global())
+}
+
+// RebalanceWith - Rebalance с операциями из реестра ops.
+func RebalanceWith(rpnarr []string, ops *operation.Registry) ([]string, error) {
+	root, err := buildTree(rpnarr, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	return balance(root, ops).appendRPN(make([]string, 0, len(rpnarr))), nil
+}
+
+// Depth возвращает глубину дерева выражения в обратной польской записи.
+func Depth(rpnarr []string) (int, error) {
+	return DepthWith(rpnarr, operation.Global())
+}
+
+// DepthWith - Depth с операциями из реестра ops.
+func DepthWith(rpnarr []string, ops *operation.Registry) (int, error) {
+	root, err := buildTree(rpnarr, ops)
+	if err != nil {
+		return 0, err
+	}
+
+	return root.depth, nil
+}
@@ -0,0 +1,154 @@
+package rpn
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+)
+
+// вычисляем RPN, чтобы сравнить значения до и после балансировки
+func evaluate(t *testing.T, rpnarr []string) float64 {
+	t.Helper()
+
+	var values []float64
+	for _, token := range rpnarr {
+		info, found := operation.Lookup(token)
+		if !found {
+			value, err := strconv.ParseFloat(token, 64)
+			if err != nil {
+				t.Fatalf("token %q: %v", token, err)
+			}
+			values = append(values, value)
+			continue
+		}
+
+		args := values[len(values)-info.Arity:]
+		values = append(values[:len(values)-info.Arity], info.Func(slices.Clone(args)...))
+	}
+
+	return values[0]
+}
+
+func TestRebalance(t *testing.T) {
+	tests := []struct {
+		expr      string
+		want      string // RPN после балансировки
+		wantDepth int
+	}{
+		{"1+2+3+4", "1 2 + 3 4 + +", 2},
+		{"1*2*3*4*5", "1 2 * 5 * 3 4 * *", 3},
+		{"1+2*3+4", "1 4 + 2 3 * +", 2},
+		{"(1+2)*(3+4)", "1 2 + 3 4 + *", 2},
+		// без ассоциативности порядок не меняется
+		{"1-2-3-4", "1 2 - 3 - 4 -", 3},
+		{"1/2/3", "1 2 / 3 /", 2},
+		// цепочки внутри неперестановочных операций тоже балансируются
+		{"(1+2+3+4)/2", "1 2 + 3 4 + + 2 /", 3},
+		{"(1+2+3+4)-(5*6*7*8)", "1 2 + 3 4 + + 5 6 * 7 8 * * -", 3},
+		{"7", "7", 0},
+		// аргументы функций балансируются, сама функция остаётся на месте
+		{"neg(1+2+3+4)", "1 2 + 3 4 + + neg", 3},
+		{"hyp(1*2*3*4, 5)+6+7", "1 2 * 3 4 * * 5 hyp 6 7 + +", 4},
+		{"clamp(1+2+3+4, 0, 5)", "1 2 + 3 4 + + 0 5 clamp", 3},
+	}
+
+	testOperations(t)
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			rpnarr, err := NewRPN(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Rebalance(rpnarr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Fatalf("got %q, want %q", strings.Join(got, " "), tt.want)
+			}
+
+			depth, err := Depth(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if depth != tt.wantDepth {
+				t.Fatalf("depth %d, want %d", depth, tt.wantDepth)
+			}
+
+			if before, after := evaluate(t, rpnarr), evaluate(t, got); math.Abs(before-after) > 1e-9 {
+				t.Fatalf("value changed from %v to %v", before, after)
+			}
+		})
+	}
+}
+
+func TestDepth(t *testing.T) {
+	tests := []struct {
+		rpn     string
+		want    int
+		wantErr bool
+	}{
+		{"1", 0, false},
+		{"1 2 +", 1, false},
+		{"1 2 + 3 +", 2, false},
+		{"1 2 + 3 4 + *", 2, false},
+		{"1 2 3 4 - - -", 3, false},
+		{"+", 0, true},
+		{"1 +", 0, true},
+		{"1 2", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rpn, func(t *testing.T) {
+			got, err := Depth(strings.Fields(tt.rpn))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("depth %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// ошибки разбора не теряются при балансировке
+func TestRebalanceErrors(t *testing.T) {
+	for _, rpn := range []string{"+", "1 2", "1 2 3 +"} {
+		if _, err := Rebalance(strings.Fields(rpn)); err == nil {
+			t.Errorf("%q: expected error", rpn)
+		}
+	}
+}
+
+// длинная цепочка балансируется до логарифмической глубины без квадратичного обхода
+func TestRebalanceLongChain(t *testing.T) {
+	const n = 100000
+
+	rpnarr := []string{"1"}
+	for i := 2; i <= n; i++ {
+		rpnarr = append(rpnarr, strconv.Itoa(i), "+")
+	}
+
+	got, err := Rebalance(rpnarr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depth, err := Depth(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bits.Len(n - 1); depth != want {
+		t.Fatalf("depth %d, want %d", depth, want)
+	}
+	if sum := evaluate(t, got); sum != n*(n+1)/2 {
+		t.Fatalf("sum %v, want %d", sum, n*(n+1)/2)
+	}
+}
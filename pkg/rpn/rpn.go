@@ -2,9 +2,12 @@ package rpn
 
 import (
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
+	"unicode"
 
+	"github.com/roadtoseniors/apicalc/pkg/operation"
 	"github.com/roadtoseniors/apicalc/pkg/stack"
 )
 
@@ -15,49 +18,64 @@ const (
 	operatorToken
 	leftBracketToken
 	rightBracketToken
+	functionToken
+	commaToken
 )
 
 // преобразуем в обратную польскую запись
 func NewRPN(input string) ([]string, error) {
-	input = strings.ReplaceAll(input, "+", " + ")
-	input = strings.ReplaceAll(input, "-", " - ")
-	input = strings.ReplaceAll(input, "*", " * ")
-	input = strings.ReplaceAll(input, "/", " / ")
-	input = strings.ReplaceAll(input, "(", " ( ")
-	input = strings.ReplaceAll(input, ")", " ) ")
+	return NewRPNWith(input, operation.Global())
+}
 
-	tokens := strings.Fields(input)
+// NewRPNWith - NewRPN с операциями из реестра ops.
+func NewRPNWith(input string, ops *operation.Registry) ([]string, error) {
+	tokens := tokenize(input, ops)
 
 	rpnarr := make([]string, 0, len(tokens))
 
 	stack := stack.NewStack[string]()
 
+	// на каждую открытую скобку: сколько аргументов функции уже начато,
+	// 0 - скобка не относится к вызову функции
+	var argCounts []int
+
 	predToken := emptyToken
 	for _, token := range tokens {
 		curToken := emptyToken
 
-		if isOperator(token) {
+		if isFunction(token, ops) {
+			stack.Push(token)
+			curToken = functionToken
+		} else if isOperator(token, ops) {
 			if isUnaryOperator(token, predToken) {
 				rpnarr = append(rpnarr, "0")
 				stack.Push(token)
 				continue
 			}
 
-			for !stack.Empty() && isOperator(stack.Top()) {
-				op := stack.Pop()
-				if operatorPriority(op) <= operatorPriority(token) {
-					rpnarr = append(rpnarr, op)
-				} else {
-					stack.Push(op)
-					break
-				}
+			for !stack.Empty() && isOperator(stack.Top(), ops) && popsBefore(stack.Top(), token, ops) {
+				rpnarr = append(rpnarr, stack.Pop())
 			}
 
 			stack.Push(token)
 			curToken = operatorToken
 		} else if token == "(" {
+			if predToken == functionToken {
+				argCounts = append(argCounts, 1)
+			} else {
+				argCounts = append(argCounts, 0)
+			}
 			stack.Push(token)
 			curToken = leftBracketToken
+		} else if token == "," {
+			for !stack.Empty() && stack.Top() != "(" {
+				rpnarr = append(rpnarr, stack.Pop())
+			}
+			if stack.Empty() || argCounts[len(argCounts)-1] == 0 {
+				return nil, fmt.Errorf("error: ',' outside of function call")
+			}
+			argCounts[len(argCounts)-1]++
+			curToken = commaToken
 		} else if token == ")" {
 			for !stack.Empty() && stack.Top() != "(" {
 				rpnarr = append(rpnarr, stack.Pop())
@@ -66,6 +84,17 @@ func NewRPN(input string) ([]string, error) {
 				return nil, fmt.Errorf("error: unpaired brackets")
 			}
 			stack.Pop()
+
+			// закрылся вызов функции
+			count := argCounts[len(argCounts)-1]
+			argCounts = argCounts[:len(argCounts)-1]
+			if count != 0 {
+				function := stack.Pop()
+				if info, _ := ops.Lookup(function); info.Arity != count {
+					return nil, fmt.Errorf("function '%s' expects %d arguments, got %d", function, info.Arity, count)
+				}
+				rpnarr = append(rpnarr, function)
+			}
 			curToken = rightBracketToken
 		} else {
 			_, err := strconv.ParseFloat(token, 64)
@@ -95,39 +124,94 @@ func NewRPN(input string) ([]string, error) {
 	return rpnarr, nil
 }
 
-// приоритет оператора
-func operatorPriority(op string) int {
-	switch op {
-	case "*", "/":
-		return 1
-	case "+", "-":
-		return 2
-	default:
-		return -1
+// разбиваем строку на скобки, операции и то, что между ними
+func tokenize(input string, ops *operation.Registry) []string {
+	// длинные символы операторов проверяются раньше коротких,
+	// имена функций выделяются как обычные слова
+	var symbols []string
+	for _, symbol := range ops.Symbols() {
+		if isOperator(symbol, ops) {
+			symbols = append(symbols, symbol)
+		}
 	}
+	symbols = append(symbols, "(", ")", ",")
+
+	var tokens []string
+	var word strings.Builder
+	flush := func() {
+		if word.Len() != 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+
+	for i := 0; i < len(input); {
+		if unicode.IsSpace(rune(input[i])) {
+			flush()
+			i++
+			continue
+		}
+
+		idx := slices.IndexFunc(symbols, func(symbol string) bool {
+			return strings.HasPrefix(input[i:], symbol)
+		})
+		if idx >= 0 {
+			flush()
+			tokens = append(tokens, symbols[idx])
+			i += len(symbols[idx])
+			continue
+		}
+
+		word.WriteByte(input[i])
+		i++
+	}
+	flush()
+
+	return tokens
+}
+
+// нужно ли выполнить операцию из стека раньше новой
+func popsBefore(top, token string, ops *operation.Registry) bool {
+	topOp, _ := ops.Lookup(top)
+	op, _ := ops.Lookup(token)
+
+	if topOp.Precedence != op.Precedence {
+		return topOp.Precedence > op.Precedence
+	}
+
+	return op.Associativity != operation.Right
 }
 
 // является ли оператором
-func isOperator(op string) bool {
-	return op == "+" || op == "-" || op == "*" || op == "/"
+func isOperator(op string, ops *operation.Registry) bool {
+	info, found := ops.Lookup(op)
+	return found && !info.Function
+}
+
+// является ли функцией
+func isFunction(token string, ops *operation.Registry) bool {
+	info, found := ops.Lookup(token)
+	return found && info.Function
 }
 
 // проверка на унарность
 func isUnaryOperator(op string, predToken int) bool {
 	return (op == "-" || op == "+") &&
-		(predToken == emptyToken || predToken == leftBracketToken || predToken == operatorToken)
+		(predToken == emptyToken || predToken == leftBracketToken || predToken == operatorToken ||
+			predToken == commaToken)
 }
 
 // проверяем корректность последовательности токенов
 func checkTokens(prev, cur int) bool {
 	switch cur {
-	case numberToken:
-		return prev == emptyToken || prev == operatorToken || prev == leftBracketToken
+	case numberToken, functionToken:
+		return prev == emptyToken || prev == operatorToken || prev == leftBracketToken || prev == commaToken
 	case leftBracketToken:
-		return prev == emptyToken || prev == operatorToken || prev == leftBracketToken
+		return prev == emptyToken || prev == operatorToken || prev == leftBracketToken ||
+			prev == commaToken || prev == functionToken
 	case rightBracketToken:
 		return prev == numberToken || prev == rightBracketToken
-	case operatorToken:
+	case operatorToken, commaToken:
 		return prev == numberToken || prev == rightBracketToken
 	default:
 		return false
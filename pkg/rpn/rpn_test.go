@@ -0,0 +1,199 @@
+package rpn
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/roadtoseniors/apicalc/pkg/operation"
+)
+
+var registerTestOperations sync.Once
+
+// операции, которые в приложении добавляют плагины агента
+func testOperations(t *testing.T) {
+	t.Helper()
+
+	registerTestOperations.Do(func() {
+		for _, op := range []operation.Operation{
+			{Symbol: "**", Arity: 2, Precedence: 3, Associativity: operation.Right, Func: func(args ...float64) float64 { return math.Pow(args[0], args[1]) }},
+			{Symbol: "neg", Arity: 1, Function: true, Func: func(args ...float64) float64 { return -args[0] }},
+			{Symbol: "hyp", Arity: 2, Function: true, Func: func(args ...float64) float64 { return math.Hypot(args[0], args[1]) }},
+			{Symbol: "clamp", Arity: 3, Function: true, Func: func(args ...float64) float64 { return min(max(args[0], args[1]), args[2]) }},
+		} {
+			if err := operation.Register(op); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNewRPN(t *testing.T) {
+	testOperations(t)
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"2+3", "2 3 +"},
+		{"2+3*4", "2 3 4 * +"},
+		{"(2+3)*4", "2 3 + 4 *"},
+		{"8-3-2", "8 3 - 2 -"},
+		{"8/4/2", "8 4 / 2 /"},
+		{" 1.5 * ( 2 - 0.5 ) ", "1.5 2 0.5 - *"},
+		{"-2+3", "0 2 - 3 +"},
+		{"2*(-3)", "2 0 3 - *"},
+		// зарегистрированный оператор: приоритет выше *, правая ассоциативность
+		{"2**3**2", "2 3 2 ** **"},
+		{"2*3**2", "2 3 2 ** *"},
+		{"2**3*2", "2 3 ** 2 *"},
+		// длинный символ не распадается на два коротких
+		{"2**3", "2 3 **"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := NewRPN(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Fatalf("got %q, want %q", strings.Join(got, " "), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRPNErrors(t *testing.T) {
+	testOperations(t)
+
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{"", "near last token"},
+		{"2+", "near last token"},
+		{"(2+3", "unpaired brackets"},
+		{"2+3)", "unpaired brackets"},
+		{"2 3", "incorrect sequence"},
+		{"2*/3", "incorrect sequence"},
+		{"()", "incorrect sequence"},
+		{"x+1", "incorrect token: 'x'"},
+		{"2*", "near last token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := NewRPN(tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	testOperations(t)
+
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"hyp(3,4)", []string{"hyp", "(", "3", ",", "4", ")"}},
+		{" hyp ( 3 , 4 ) ", []string{"hyp", "(", "3", ",", "4", ")"}},
+		{"2**neg(1.5)", []string{"2", "**", "neg", "(", "1.5", ")"}},
+		{"clamp(a1,b_2,3)", []string{"clamp", "(", "a1", ",", "b_2", ",", "3", ")"}},
+	}
+
+	for _, tt := range tests {
+		if got := tokenize(tt.input, operation.Global()); !slices.Equal(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestNewRPNFunctions(t *testing.T) {
+	testOperations(t)
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"neg(2)", "2 neg"},
+		{"hyp(3,4)", "3 4 hyp"},
+		{"hyp(1+2, 3*4)", "1 2 + 3 4 * hyp"},
+		{"neg(neg(2))", "2 neg neg"},
+		{"clamp(neg(1), (2+3), hyp(1,2))", "1 neg 2 3 + 1 2 hyp clamp"},
+		{"2*neg(3)+1", "2 3 neg * 1 +"},
+		{"hyp(-1, 2)", "0 1 - 2 hyp"},
+		{"(hyp(3,4))", "3 4 hyp"},
+		{"2**hyp(3,4)", "2 3 4 hyp **"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := NewRPN(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Fatalf("got %q, want %q", strings.Join(got, " "), tt.want)
+			}
+		})
+	}
+}
+
+// количество аргументов считается для каждой скобки вызова отдельно
+func TestNewRPNFunctionErrors(t *testing.T) {
+	testOperations(t)
+
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{"hyp(1)", "'hyp' expects 2 arguments, got 1"},
+		{"neg(1,2)", "'neg' expects 1 arguments, got 2"},
+		{"clamp(1,hyp(2,3))", "'clamp' expects 3 arguments, got 2"},
+		{"hyp(neg(1,2),3)", "'neg' expects 1 arguments, got 2"},
+		{"1,2", "',' outside of function call"},
+		{"(1,2)", "',' outside of function call"},
+		{"hyp(1,(2,3))", "',' outside of function call"},
+		{"neg()", "incorrect sequence"},
+		{"neg 2", "incorrect sequence"},
+		{"hyp(1,)", "incorrect sequence"},
+		{"hyp(,1)", "incorrect sequence"},
+		{"neg(1", "unpaired brackets"},
+		{"2 neg(1)", "incorrect sequence"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := NewRPN(tt.expr)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// операции реестра видны только при разборе с этим реестром
+func TestNewRPNWith(t *testing.T) {
+	ops := operation.NewRegistry(operation.Global())
+	if err := ops.Register(operation.Operation{Symbol: "npv_rpn", Arity: 2, Function: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := NewRPNWith("npv_rpn(1, 2+3)", ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1 2 3 + npv_rpn"; strings.Join(got, " ") != want {
+		t.Fatalf("got %q, want %q", strings.Join(got, " "), want)
+	}
+
+	if _, err := NewRPN("npv_rpn(1, 2)"); err == nil {
+		t.Fatal("operation of another registry parsed")
+	}
+}
@@ -0,0 +1,444 @@
+// Package settings загружает конфигурацию из YAML-файла, окружения и флагов.
+//
+// Поля структуры конфигурации описываются тегами:
+//
+//	key    - ключ в файле конфигурации
+//	env    - переменная окружения
+//	flag   - флаг командной строки
+//	usage  - описание для -help
+//	min    - наименьшее допустимое значение числа или длительности
+//	oneof  - допустимые значения строки через |
+//	secret - значение не выводится в -print-config
+//
+// Значения по умолчанию берутся из самой структуры, затем по порядку
+// применяются файл (-config или CONFIG_FILE), окружение и флаги.
+// Длительность задаётся числом миллисекунд или строкой вида "1.5s".
+package settings
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrPrinted - конфигурация выведена по -print-config, программе пора завершиться
+var ErrPrinted = errors.New("configuration printed")
+
+// Validator - проверки, затрагивающие несколько полей
+type Validator interface {
+	Validate() error
+}
+
+// поле конфигурации с описанием из тегов
+type field struct {
+	value  reflect.Value
+	key    string
+	env    string
+	flag   string
+	usage  string
+	min    string
+	oneof  string
+	secret bool
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Load заполняет cfg, args - аргументы командной строки без имени программы.
+func Load(cfg any, name string, args []string) error {
+	fields, err := describe(cfg)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file (env CONFIG_FILE)")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+
+	// флаги применяются последними, поэтому пока только запоминаем их
+	flagValues := make(map[string]string)
+	for _, f := range fields {
+		if len(f.flag) == 0 {
+			continue
+		}
+
+		usage := fmt.Sprintf("%s (key %s)", f.usage, f.key)
+		record := func(val string) error {
+			flagValues[f.key] = val
+			return nil
+		}
+		if f.value.Kind() == reflect.Bool {
+			fs.BoolFunc(f.flag, usage, record)
+		} else {
+			fs.Func(f.flag, usage, record)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if len(*configFile) != 0 {
+		if err := loadFile(*configFile, fields); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range fields {
+		if len(f.env) == 0 {
+			continue
+		}
+		if val := os.Getenv(f.env); len(val) != 0 {
+			if err := f.set(val); err != nil {
+				return fmt.Errorf("config key %q (env %s): %w", f.key, f.env, err)
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if val, found := flagValues[f.key]; found {
+			if err := f.set(val); err != nil {
+				return fmt.Errorf("config key %q (flag -%s): %w", f.key, f.flag, err)
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if err := f.check(); err != nil {
+			return fmt.Errorf("config key %q: %w", f.key, err)
+		}
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if *printConfig {
+		if err := Print(os.Stdout, cfg); err != nil {
+			return err
+		}
+		return ErrPrinted
+	}
+
+	return nil
+}
+
+// Print выводит конфигурацию в формате файла конфигурации.
+func Print(w io.Writer, cfg any) error {
+	fields, err := describe(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		value, err := f.format()
+		if err != nil {
+			return fmt.Errorf("config key %q: %w", f.key, err)
+		}
+
+		var sources []string
+		if len(f.env) != 0 {
+			sources = append(sources, "env "+f.env)
+		}
+		if len(f.flag) != 0 {
+			sources = append(sources, "flag -"+f.flag)
+		}
+
+		line := fmt.Sprintf("%s: %s", f.key, value)
+		if len(sources) != 0 {
+			line = fmt.Sprintf("%-40s # %s", line, strings.Join(sources, ", "))
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// описываем поля структуры по тегам
+func describe(cfg any) ([]field, error) {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("settings: pointer to struct expected, got %T", cfg)
+	}
+	v = v.Elem()
+
+	var fields []field
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag
+		key := tag.Get("key")
+		if len(key) == 0 {
+			continue
+		}
+
+		fields = append(fields, field{
+			value:  v.Field(i),
+			key:    key,
+			env:    tag.Get("env"),
+			flag:   tag.Get("flag"),
+			usage:  tag.Get("usage"),
+			min:    tag.Get("min"),
+			oneof:  tag.Get("oneof"),
+			secret: tag.Get("secret") == "true",
+		})
+	}
+
+	return fields, nil
+}
+
+// применяем файл конфигурации
+func loadFile(path string, fields []field) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return setValues(values, fields, "in "+path)
+}
+
+// применяем значения по ключам, where - откуда они пришли, для ошибок
+func setValues(values map[string]any, fields []field, where string) error {
+	// порядок ключей не важен, но ошибки должны быть воспроизводимыми
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		idx := slices.IndexFunc(fields, func(f field) bool { return f.key == key })
+		if idx < 0 {
+			return fmt.Errorf("unknown config key %q %s", key, where)
+		}
+
+		if err := fields[idx].set(scalar(values[key])); err != nil {
+			return fmt.Errorf("config key %q %s: %w", key, where, err)
+		}
+	}
+
+	return nil
+}
+
+// Apply меняет в cfg значения по ключам файла конфигурации и проверяет результат.
+// При ошибке cfg может быть изменён частично, поэтому применять стоит к копии.
+func Apply(cfg any, values map[string]any) error {
+	fields, err := describe(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := setValues(values, fields, "in request"); err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		if err := f.check(); err != nil {
+			return fmt.Errorf("config key %q: %w", f.key, err)
+		}
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		return v.Validate()
+	}
+
+	return nil
+}
+
+// Diff описывает отличия двух конфигураций одного типа строками "key: old -> new".
+func Diff(old, new any) ([]string, error) {
+	oldFields, err := describe(old)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := describe(new)
+	if err != nil {
+		return nil, err
+	}
+	if len(oldFields) != len(newFields) {
+		return nil, fmt.Errorf("settings: cannot compare %T and %T", old, new)
+	}
+
+	var changes []string
+	for i, f := range oldFields {
+		was, err := f.format()
+		if err != nil {
+			return nil, fmt.Errorf("config key %q: %w", f.key, err)
+		}
+		now, err := newFields[i].format()
+		if err != nil {
+			return nil, fmt.Errorf("config key %q: %w", f.key, err)
+		}
+
+		if f.secret && !reflect.DeepEqual(f.value.Interface(), newFields[i].value.Interface()) {
+			changes = append(changes, fmt.Sprintf("%s: changed", f.key))
+		} else if was != now {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", f.key, was, now))
+		}
+	}
+
+	return changes, nil
+}
+
+// значение из YAML в том виде, в каком оно пришло бы из окружения
+func scalar(raw any) string {
+	switch val := raw.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case map[string]any:
+		pairs := make([]string, 0, len(val))
+		for k, v := range val {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", k, scalar(v)))
+		}
+		slices.Sort(pairs)
+		return strings.Join(pairs, ",")
+	case []any:
+		items := make([]string, 0, len(val))
+		for _, v := range val {
+			items = append(items, scalar(v))
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// разбираем длительность: число миллисекунд или строка с единицами
+func parseDuration(val string) (time.Duration, error) {
+	if ms, err := strconv.ParseFloat(val, 64); err == nil {
+		if ms < 0 {
+			return 0, fmt.Errorf("duration must not be negative")
+		}
+		return time.Duration(ms * float64(time.Millisecond)), nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: use milliseconds or a value like 1.5s", val)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration must not be negative")
+	}
+
+	return d, nil
+}
+
+func (f field) set(val string) error {
+	if u, ok := f.value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(val))
+	}
+
+	if f.value.Type() == durationType {
+		d, err := parseDuration(val)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(val)
+	case reflect.Int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", val)
+		}
+		f.value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", val)
+		}
+		f.value.SetBool(b)
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", val)
+		}
+		f.value.SetFloat(x)
+	default:
+		return fmt.Errorf("unsupported type %s", f.value.Type())
+	}
+
+	return nil
+}
+
+// проверяем ограничения из тегов min и oneof
+func (f field) check() error {
+	if len(f.min) != 0 {
+		if f.value.Type() == durationType {
+			min, err := parseDuration(f.min)
+			if err != nil {
+				return err
+			}
+			if time.Duration(f.value.Int()) < min {
+				return fmt.Errorf("must be at least %v", min)
+			}
+		} else if f.value.Kind() == reflect.Int {
+			min, err := strconv.Atoi(f.min)
+			if err != nil {
+				return err
+			}
+			if f.value.Int() < int64(min) {
+				return fmt.Errorf("must be at least %d", min)
+			}
+		}
+	}
+
+	if len(f.oneof) != 0 {
+		allowed := strings.Split(f.oneof, "|")
+		if !slices.Contains(allowed, f.value.String()) {
+			return fmt.Errorf("must be one of %s, got %q", strings.Join(allowed, ", "), f.value.String())
+		}
+	}
+
+	return nil
+}
+
+// значение поля для вывода в YAML
+func (f field) format() (string, error) {
+	if f.secret && !f.value.IsZero() {
+		return `"***"`, nil
+	}
+
+	var val any = f.value.Interface()
+	if m, ok := val.(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		if err != nil {
+			return "", err
+		}
+		val = string(text)
+	} else if d, ok := val.(time.Duration); ok {
+		val = d.String()
+	}
+
+	out, err := yaml.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,238 @@
+package settings
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Port    int           `key:"port" env:"TEST_PORT" flag:"port" min:"1"`
+	Name    string        `key:"name" env:"TEST_NAME" flag:"name"`
+	Timeout time.Duration `key:"timeout" env:"TEST_TIMEOUT_MS" min:"1s"`
+	Mode    string        `key:"mode" env:"TEST_MODE" oneof:"fast|slow"`
+	Verbose bool          `key:"verbose" env:"TEST_VERBOSE" flag:"v"`
+	Rate    float64       `key:"rate" env:"TEST_RATE"`
+	Secret  string        `key:"secret" env:"TEST_SECRET" secret:"true"`
+}
+
+func (cfg *testConfig) Validate() error {
+	if cfg.Name == "invalid" {
+		return fmt.Errorf("config key \"name\" must not be %q", cfg.Name)
+	}
+
+	return nil
+}
+
+func defaultTestConfig() testConfig {
+	return testConfig{Port: 8080, Name: "default", Timeout: 5 * time.Second, Mode: "fast"}
+}
+
+// файл конфигурации во временном каталоге теста
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// значения по умолчанию < файл < окружение < флаги
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		args  []string
+		check func(cfg testConfig) bool
+	}{
+		{"defaults", "", nil, nil, func(cfg testConfig) bool {
+			return cfg == defaultTestConfig()
+		}},
+		{"file over defaults", "port: 9000\nname: file\n", nil, nil, func(cfg testConfig) bool {
+			return cfg.Port == 9000 && cfg.Name == "file" && cfg.Mode == "fast"
+		}},
+		{"env over file", "port: 9000\nname: file\n", map[string]string{"TEST_PORT": "9100"}, nil, func(cfg testConfig) bool {
+			return cfg.Port == 9100 && cfg.Name == "file"
+		}},
+		{"flag over env", "port: 9000\n", map[string]string{"TEST_PORT": "9100"}, []string{"-port", "9200"}, func(cfg testConfig) bool {
+			return cfg.Port == 9200
+		}},
+		{"bool flag without value", "", nil, []string{"-v"}, func(cfg testConfig) bool {
+			return cfg.Verbose
+		}},
+		{"duration in milliseconds", "timeout: 1500\n", nil, nil, func(cfg testConfig) bool {
+			return cfg.Timeout == 1500*time.Millisecond
+		}},
+		{"duration with units", "", map[string]string{"TEST_TIMEOUT_MS": "2.5s"}, nil, func(cfg testConfig) bool {
+			return cfg.Timeout == 2500*time.Millisecond
+		}},
+		{"float and secret", "rate: 0.5\nsecret: s3cret\n", nil, nil, func(cfg testConfig) bool {
+			return cfg.Rate == 0.5 && cfg.Secret == "s3cret"
+		}},
+		{"empty env keeps the file value", "name: file\n", map[string]string{"TEST_NAME": ""}, nil, func(cfg testConfig) bool {
+			return cfg.Name == "file"
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			for key, val := range tt.env {
+				t.Setenv(key, val)
+			}
+
+			args := tt.args
+			if len(tt.file) != 0 {
+				args = append([]string{"-config", writeConfig(t, tt.file)}, args...)
+			}
+
+			cfg := defaultTestConfig()
+			if err := Load(&cfg, "test", args); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(cfg) {
+				t.Fatalf("unexpected config %+v", cfg)
+			}
+		})
+	}
+}
+
+// файл берётся из CONFIG_FILE, если не задан -config
+func TestLoadConfigFileSource(t *testing.T) {
+	fromEnv := writeConfig(t, "name: env file\n")
+	fromFlag := writeConfig(t, "name: flag file\n")
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"CONFIG_FILE", nil, "env file"},
+		{"-config over CONFIG_FILE", []string{"-config", fromFlag}, "flag file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", fromEnv)
+
+			cfg := defaultTestConfig()
+			if err := Load(&cfg, "test", tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Name != tt.want {
+				t.Fatalf("name %q, want %q", cfg.Name, tt.want)
+			}
+		})
+	}
+}
+
+// ошибка называет ключ и источник значения
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		wantErr string
+	}{
+		{"unknown key in file", "prot: 1\n", nil, nil, `unknown config key "prot" in `},
+		{"bad integer in file", "port: abc\n", nil, nil, `config key "port" in `},
+		{"bad integer in env", "", map[string]string{"TEST_PORT": "x"}, nil, `config key "port" (env TEST_PORT): invalid integer "x"`},
+		{"bad integer in flag", "", nil, []string{"-port", "x"}, `config key "port" (flag -port): invalid integer "x"`},
+		{"bad boolean in env", "", map[string]string{"TEST_VERBOSE": "maybe"}, nil, `config key "verbose" (env TEST_VERBOSE): invalid boolean "maybe"`},
+		{"bad number in env", "", map[string]string{"TEST_RATE": "fast"}, nil, `config key "rate" (env TEST_RATE): invalid number "fast"`},
+		{"bad duration in env", "", map[string]string{"TEST_TIMEOUT_MS": "soon"}, nil, `config key "timeout" (env TEST_TIMEOUT_MS): invalid duration "soon"`},
+		{"negative duration", "", map[string]string{"TEST_TIMEOUT_MS": "-5"}, nil, `config key "timeout" (env TEST_TIMEOUT_MS): duration must not be negative`},
+		{"below min", "port: 0\n", nil, nil, `config key "port": must be at least 1`},
+		{"duration below min", "timeout: 10\n", nil, nil, `config key "timeout": must be at least 1s`},
+		{"not one of", "mode: medium\n", nil, nil, `config key "mode": must be one of fast, slow, got "medium"`},
+		{"validator", "name: invalid\n", nil, nil, `config key "name" must not be "invalid"`},
+		{"unexpected argument", "", nil, []string{"extra"}, `unexpected argument "extra"`},
+		{"unknown flag", "", nil, []string{"-nope"}, "flag provided but not defined"},
+		{"missing file", "", nil, []string{"-config", "/nonexistent/config.yaml"}, "config file:"},
+		{"broken yaml", "port: [1\n", nil, nil, "config file "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			for key, val := range tt.env {
+				t.Setenv(key, val)
+			}
+
+			args := tt.args
+			if len(tt.file) != 0 {
+				args = append([]string{"-config", writeConfig(t, tt.file)}, args...)
+			}
+
+			// флаги печатают ошибки и справку в stderr
+			devNull, _ := os.Open(os.DevNull)
+			stderr := os.Stderr
+			os.Stderr = devNull
+			defer func() {
+				os.Stderr = stderr
+				devNull.Close()
+			}()
+
+			cfg := defaultTestConfig()
+			err := Load(&cfg, "test", args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyAndDiff(t *testing.T) {
+	old := defaultTestConfig()
+	old.Secret = "one"
+
+	next := old
+	err := Apply(&next, map[string]any{"port": 9000, "timeout": "2s", "secret": "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := Diff(&old, &next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"port: 8080 -> 9000", "timeout: 5s -> 2s", "secret: changed"}
+	if !slices.Equal(changes, want) {
+		t.Fatalf("changes %q, want %q", changes, want)
+	}
+
+	bad := old
+	if err := Apply(&bad, map[string]any{"prot": 1}); err == nil || !strings.Contains(err.Error(), `unknown config key "prot" in request`) {
+		t.Fatalf("error %v", err)
+	}
+	if err := Apply(&bad, map[string]any{"port": 0}); err == nil || !strings.Contains(err.Error(), `config key "port": must be at least 1`) {
+		t.Fatalf("error %v", err)
+	}
+}
+
+// секреты не выводятся
+func TestPrintHidesSecrets(t *testing.T) {
+	cfg := defaultTestConfig()
+	cfg.Secret = "s3cret"
+
+	var out strings.Builder
+	if err := Print(&out, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "s3cret") || !strings.Contains(out.String(), `secret: "***"`) {
+		t.Fatalf("secret printed:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "# env TEST_PORT, flag -port") {
+		t.Fatalf("sources are not printed:\n%s", out.String())
+	}
+}